@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
+	"time"
 
 	// "github.com/davecgh/go-spew/spew"
 	"github.com/jessegalley/rrd2prom"
@@ -14,59 +21,342 @@ import (
 
 func main() {
 	var (
-		rrdURL = flag.String("url", "", "URL or path of the RRD file to monitor")
-		name   = flag.String("name", "default", "Name identifier for the RRD metrics")
+		configPath = flag.String("config", "", "Path of a sources file listing the RRD files to monitor")
+		rrdURL     = flag.String("url", "", "URL or path of the RRD file to monitor")
+		name       = flag.String("name", "default", "Name identifier for the RRD metrics")
+		listen     = flag.String("listen", "", "Address to serve HTTP endpoints on, e.g. :9191")
+		logLevel   = flag.String("log-level", "info", "Minimum level to log at: debug, info, warn or error")
+		stdout     = flag.Bool("stdout", false, "Print every metric to stdout, always on when metrics aren't served or sent anywhere else")
+		textfile   = flag.String("textfile-dir", "", "Directory of node_exporter's textfile collector to keep rrd2prom.prom up to date in")
+		workers    = flag.Int("workers", 0, "How many RRD files to read at once, defaults to 4 per CPU")
+		grace      = flag.Duration("update-grace", 5*time.Second, "How long after an RRD's expected write to read it")
+		maxBackoff = flag.Duration("max-backoff", 10*time.Minute, "Longest wait between reads of a failing source")
+		threshold  = flag.Int("circuit-threshold", 5, "Failures in a row before a source's circuit opens")
+		giveUp     = flag.Int("max-failures", 0, "Failures in a row before a source is dropped, 0 to never drop")
+		timeout    = flag.Duration("timeout", 0, "Longest a single read of -url can take, 0 for no limit")
+		stopWait   = flag.Duration("shutdown-timeout", 30*time.Second, "Longest to wait for sinks to flush on shutdown")
+		nameTmpl   = flag.String("name-template", rrd2prom.DefaultNameTemplate, "Template for metric names, using .Prefix, .File, .DS, .Type and .Unit")
+		namePrefix = flag.String("name-prefix", rrd2prom.DefaultNamePrefix, "Prefix passed to the name template")
+		utf8Names  = flag.Bool("utf8-names", false, "Keep metric names as the template makes them, quoting them in OpenMetrics UTF-8 style")
+		infoMetric = flag.Bool("info-metrics", false, "Export rrd_info, rrd_ds_info and rrd_rra_info metrics describing each file's layout")
+		rates      = flag.String("rates", "off", "Export per-second rates of counters: off, alongside the raw values, or only")
+		once       = flag.Bool("once", false, "Read every source once, print or push the metrics and exit, nonzero if any source failed")
+		pushURL    = flag.String("push-gateway", "", "With -once, push the metrics to the Pushgateway at this URL instead of printing them")
+		job        = flag.String("job", "rrd2prom", "Job to push the metrics as")
+		otlpURL    = flag.String("otlp-endpoint", "", "Also export metrics with OTLP over HTTP to this URL, e.g. http://collector:4318/v1/metrics")
+		influxURL  = flag.String("influx-url", "", "Also write metrics to the InfluxDB 2 server at this URL, e.g. http://influx:8086")
+		influxOrg  = flag.String("influx-org", "", "InfluxDB organization to write to")
+		influxBkt  = flag.String("influx-bucket", "", "InfluxDB bucket to write to")
+		influxMeas = flag.String("influx-measurement", rrd2prom.DefaultInfluxMeasurement, "Template for InfluxDB measurement names, using .Name, .File, .DS, .Type, .Labels and .LabelValues")
+		graphite   = flag.String("graphite-addr", "", "Also write metrics to the Graphite plaintext listener at this host:port")
+		graphPath  = flag.String("graphite-path", rrd2prom.DefaultGraphitePath, "Template for Graphite paths, using .Name, .File, .DS, .Type, .Labels and .LabelValues")
+		statsd     = flag.String("statsd-addr", "", "Also send metrics to the DogStatsD agent at this host:port")
+		statsdRate = flag.Float64("statsd-sample-rate", 1, "Share of metrics sent to the DogStatsD agent, between 0 and 1")
+		statsdMTU  = flag.Int("statsd-max-packet", rrd2prom.DefaultStatsDPacket, "Largest packet sent to the DogStatsD agent, in bytes")
+		grouping   = labelFlag{}
+		otlpHeader = labelFlag{}
 	)
+	flag.Var(grouping, "grouping", "Grouping label to push the metrics with, as name=value, can be repeated")
+	flag.Var(otlpHeader, "otlp-header", "Header to send with OTLP exports, as name=value, can be repeated")
 
 	flag.Parse()
 
-	if *rrdURL == "" {
+	if *rrdURL == "" && *configPath == "" {
 		flag.Usage()
 		os.Exit(1)
 	}
+	if *pushURL != "" && !*once {
+		log.Fatalf("-push-gateway only works with -once")
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		log.Fatalf("invalid -log-level %s: %v", *logLevel, err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
 
-	// create the RRD file
-	rrdFile, err := rrd2prom.NewRRDFile(*rrdURL, *name)
+	namer, err := rrd2prom.NewNamer(rrd2prom.NamingOptions{
+		Template: *nameTmpl,
+		Prefix:   *namePrefix,
+		UTF8:     *utf8Names,
+	})
 	if err != nil {
-		log.Fatalf("couldn't open rrd file at: %s (%v)", *rrdURL, err)
+		log.Fatalf("invalid -name-template: %v", err)
 	}
 
-	// create manager with our RRD file
-	manager, err := rrd2prom.NewRRDManager([]*rrd2prom.RRDFile{rrdFile})
+	rateMode, err := rrd2prom.ParseRateMode(*rates)
+	if err != nil {
+		log.Fatalf("invalid -rates: %v", err)
+	}
+
+	// metrics are fanned out to the /metrics store and, optionally, to
+	// stdout
+	store := rrd2prom.NewStore()
+	opts := []rrd2prom.Option{
+		rrd2prom.WithLogger(logger),
+		rrd2prom.WithNamer(namer),
+		rrd2prom.WithRates(rateMode),
+		rrd2prom.WithWorkers(*workers),
+		rrd2prom.WithUpdateGrace(*grace),
+		rrd2prom.WithBackoff(*maxBackoff),
+		rrd2prom.WithCircuitBreaker(*threshold, *giveUp),
+	}
+	// a single pass has to deliver everything, it can't drop batches to
+	// keep up
+	policy := rrd2prom.SinkDrop
+	if *once {
+		policy = rrd2prom.SinkBlock
+	}
+	opts = append(opts, rrd2prom.WithSink(store, rrd2prom.SinkOptions{Name: "store", Policy: policy}))
+	if *infoMetric {
+		opts = append(opts, rrd2prom.WithInfoMetrics())
+	}
+
+	if *textfile != "" {
+		sink, err := rrd2prom.NewTextfileSink(filepath.Join(*textfile, "rrd2prom.prom"), 0)
+		if err != nil {
+			log.Fatalf("invalid -textfile-dir: %v", err)
+		}
+		opts = append(opts, rrd2prom.WithSink(sink, rrd2prom.SinkOptions{Name: "textfile", Policy: policy}))
+	}
+
+	if *influxURL != "" {
+		// the token is taken from the environment so it doesn't show up
+		// in ps
+		sink, err := rrd2prom.NewInfluxSink(rrd2prom.InfluxOptions{
+			URL:         *influxURL,
+			Org:         *influxOrg,
+			Bucket:      *influxBkt,
+			Token:       os.Getenv("INFLUX_TOKEN"),
+			Measurement: *influxMeas,
+		})
+		if err != nil {
+			log.Fatalf("invalid -influx-url: %v", err)
+		}
+		opts = append(opts, rrd2prom.WithSink(sink, rrd2prom.SinkOptions{Name: "influx", Policy: policy}))
+	}
+
+	if *graphite != "" {
+		sink, err := rrd2prom.NewGraphiteSink(rrd2prom.GraphiteOptions{Address: *graphite, Path: *graphPath})
+		if err != nil {
+			log.Fatalf("invalid -graphite-addr: %v", err)
+		}
+		opts = append(opts, rrd2prom.WithSink(sink, rrd2prom.SinkOptions{Name: "graphite", Policy: policy}))
+	}
+
+	if *statsd != "" {
+		sink, err := rrd2prom.NewStatsDSink(rrd2prom.StatsDOptions{Address: *statsd, MaxPacket: *statsdMTU, SampleRate: *statsdRate})
+		if err != nil {
+			log.Fatalf("invalid -statsd-addr: %v", err)
+		}
+		opts = append(opts, rrd2prom.WithSink(sink, rrd2prom.SinkOptions{Name: "statsd", Policy: policy}))
+	}
+
+	if *otlpURL != "" {
+		sink, err := rrd2prom.NewOTLPSink(rrd2prom.OTLPOptions{Endpoint: *otlpURL, Headers: otlpHeader})
+		if err != nil {
+			log.Fatalf("invalid -otlp-endpoint: %v", err)
+		}
+		opts = append(opts, rrd2prom.WithSink(sink, rrd2prom.SinkOptions{Name: "otlp", Policy: policy}))
+	}
+
+	var printer *rrd2prom.ChanSink
+	exporting := *listen != "" || *textfile != "" || *otlpURL != "" || *influxURL != "" || *graphite != "" || *statsd != ""
+	if !*once && (*stdout || !exporting) {
+		printer = rrd2prom.NewChanSink(1000)
+		opts = append(opts, rrd2prom.WithSink(printer, rrd2prom.SinkOptions{Name: "stdout"}))
+	}
+
+	manager, err := rrd2prom.NewRRDManager(nil, opts...)
 	if err != nil {
 		log.Fatalf("couldn't create manager: %v", err)
 	}
 
-  // spew.Dump(manager)
-	// set up signal handling for graceful shutdown
+	// reload re-reads the sources file and applies it to the manager,
+	// a bad config is rejected and leaves the running one in place
+	reload := func() error {
+		if *configPath == "" {
+			return fmt.Errorf("no config file to reload, start with -config")
+		}
+		cfg, err := rrd2prom.LoadConfig(*configPath)
+		if err != nil {
+			return err
+		}
+		return manager.ApplyConfig(cfg)
+	}
+
+	// sources that couldn't be opened for a single pass, the rest are still
+	// read and pushed
+	failedOpens := 0
+	switch {
+	case *configPath != "" && *once:
+		cfg, err := rrd2prom.LoadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("couldn't load config from %s: %v", *configPath, err)
+		}
+		files, errs := cfg.OpenSources()
+		for _, err := range errs {
+			logger.Error("couldn't open source", "error", err)
+		}
+		failedOpens = len(errs)
+		for _, rrdFile := range files {
+			if err := manager.Add(rrdFile); err != nil {
+				log.Fatalf("couldn't add rrd file: %v", err)
+			}
+		}
+	case *configPath != "":
+		if err := reload(); err != nil {
+			log.Fatalf("couldn't load config from %s: %v", *configPath, err)
+		}
+	case *once:
+		// the single pass reads it, and reports it if it can't
+		rrdFile := rrd2prom.NewUnreadRRDFile(*rrdURL, *name, nil)
+		rrdFile.Timeout = *timeout
+		if err := manager.Add(rrdFile); err != nil {
+			log.Fatalf("couldn't add rrd file: %v", err)
+		}
+	default:
+		// create the RRD file
+		rrdFile, err := rrd2prom.NewRRDFile(*rrdURL, *name)
+		if err != nil {
+			log.Fatalf("couldn't open rrd file at: %s (%v)", *rrdURL, err)
+		}
+		rrdFile.Timeout = *timeout
+		if err := manager.Add(rrdFile); err != nil {
+			log.Fatalf("couldn't add rrd file: %v", err)
+		}
+	}
+
+	if *once {
+		code := runOnce(logger, manager, store, *pushURL, *job, grouping, *utf8Names)
+		if failedOpens > 0 {
+			code = 1
+		}
+		os.Exit(code)
+	}
+
+	// spew.Dump(manager)
+	// set up signal handling for graceful shutdown and config reloads
 	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
-
-	// start a goroutine to handle messages and metrics
-	go func() {
-		for {
-			select {
-			case msg := <-manager.Msgs:
-				fmt.Printf("MSG: %s\n", msg)
-			case err := <-manager.Errors:
-				fmt.Printf("ERROR: %v\n", err)
-			case metric := <-manager.Metrics:
-				fmt.Printf("METRIC: %s{source=\"%s\"} %d [%v]\n", 
-					metric.Name, 
-					metric.Source, 
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	if *listen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", store.Handler(manager.WriteSelfMetrics))
+		mux.HandleFunc("/-/ready", func(w http.ResponseWriter, r *http.Request) {
+			if !manager.Ready() {
+				http.Error(w, "not ready", http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintln(w, "ready")
+		})
+		mux.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if err := reload(); err != nil {
+				logger.Error("reload failed", "error", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			logger.Info("config reloaded")
+		})
+
+		go func() {
+			if err := http.ListenAndServe(*listen, mux); err != nil {
+				log.Fatalf("couldn't serve HTTP on %s: %v", *listen, err)
+			}
+		}()
+	}
+
+	// start a goroutine to print metrics
+	if printer != nil {
+		go func() {
+			for metric := range printer.C {
+				fmt.Printf("METRIC: %s{file=\"%s\"} %g [%v]\n",
+					metric.Name,
+					metric.File,
 					metric.Value,
 					metric.Timestamp)
 			}
-		}
-	}()
+		}()
+	}
 
 	// start the manager
-	go manager.Run()
+	if err := manager.Start(context.Background()); err != nil {
+		log.Fatalf("couldn't start manager: %v", err)
+	}
 
-	// wait for shutdown signal
-	<-signals
+	// wait for shutdown signal, reloading the config on SIGHUP
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if err := reload(); err != nil {
+			logger.Error("reload failed", "error", err)
+			continue
+		}
+		logger.Info("config reloaded")
+	}
 	fmt.Println("\nShutting down...")
-	
+
 	// stop the manager and wait for cleanup
-	manager.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), *stopWait)
+	defer cancel()
+	if err := manager.Shutdown(ctx); err != nil {
+		logger.Error("shutdown didn't finish in time", "error", err)
+		return
+	}
+	if err := manager.Wait(); err != nil {
+		logger.Warn("sources failed while running", "error", err)
+	}
+}
+
+// runOnce reads every source a single time and pushes or prints the
+// result, returning the exit code
+func runOnce(logger *slog.Logger, manager *rrd2prom.RRDManager, store *rrd2prom.Store, pushURL, job string, grouping map[string]string, utf8 bool) int {
+	code := 0
+	if err := manager.CollectOnce(context.Background()); err != nil {
+		logger.Error("sources failed", "error", err)
+		code = 1
+	}
+
+	if pushURL == "" {
+		if err := store.WriteText(os.Stdout); err != nil {
+			logger.Error("couldn't print metrics", "error", err)
+			return 1
+		}
+		return code
+	}
+
+	pusher := &rrd2prom.Pusher{URL: pushURL, Job: job, Grouping: grouping, UTF8: utf8}
+	if err := pusher.Push(context.Background(), store); err != nil {
+		logger.Error("push failed", "error", err)
+		return 1
+	}
+
+	return code
+}
+
+// labelFlag collects repeated name=value flags
+type labelFlag map[string]string
+
+func (f labelFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for name, value := range f {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f labelFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected name=value, got %q", s)
+	}
+	f[name] = value
+	return nil
 }
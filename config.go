@@ -0,0 +1,401 @@
+package rrd2prom
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the top level of a sources file, see testdata/sources.yaml
+// for an example.
+type Config struct {
+	// Interval is the default polling interval for every source that
+	// doesn't set its own. Zero means poll at the RRD's own step.
+	Interval Duration `yaml:"interval"`
+
+	// Timeout is the default limit on how long a single read can take,
+	// for every source that doesn't set its own. Zero means no limit.
+	Timeout Duration `yaml:"timeout"`
+
+	// Labels are added to the metrics of every source, and
+	// LabelPatterns are matched against every source's location with
+	// each named capture group becoming a label. A source's own labels
+	// and patterns are applied on top.
+	Labels        map[string]string `yaml:"labels"`
+	LabelPatterns []string          `yaml:"label_patterns"`
+
+	// MetricRelabelConfigs rewrite or drop the metrics of every source
+	// before they're exported. A source's own rules run after these.
+	MetricRelabelConfigs []RelabelConfig `yaml:"metric_relabel_configs"`
+
+	// IncludeDS and ExcludeDS are regexes picking which data sources are
+	// read from every source, see NewDSFilter. A source's own IncludeDS
+	// replaces these, its ExcludeDS is added to them.
+	IncludeDS []string `yaml:"include_ds"`
+	ExcludeDS []string `yaml:"exclude_ds"`
+
+	// Transforms change data source values before they're exported,
+	// keyed by data source name. A source's own transform for a data
+	// source replaces the one set here.
+	Transforms map[string]TransformConfig `yaml:"transforms"`
+
+	Sources []SourceConfig `yaml:"sources"`
+}
+
+// SourceConfig describes a single RRD file to collect from.
+type SourceConfig struct {
+	Location string   `yaml:"location"`
+	Name     string   `yaml:"name"`
+	Interval Duration `yaml:"interval"`
+	Timeout  Duration `yaml:"timeout"`
+
+	Labels        map[string]string `yaml:"labels"`
+	LabelPatterns []string          `yaml:"label_patterns"`
+
+	MetricRelabelConfigs []RelabelConfig `yaml:"metric_relabel_configs"`
+
+	IncludeDS []string `yaml:"include_ds"`
+	ExcludeDS []string `yaml:"exclude_ds"`
+
+	Transforms map[string]TransformConfig `yaml:"transforms"`
+}
+
+// Duration is a time.Duration that can be written in config either as a
+// plain number of seconds (60) or as a Go duration string ("1m30s").
+type Duration time.Duration
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	var secs float64
+	if err := node.Decode(&secs); err == nil {
+		*d = Duration(secs * float64(time.Second))
+		return nil
+	}
+
+	var s string
+	if err := node.Decode(&s); err != nil {
+		return fmt.Errorf("line %d: invalid duration", node.Line)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid duration %q", node.Line, s)
+	}
+	*d = Duration(parsed)
+
+	return nil
+}
+
+// LoadConfig reads, parses and validates the sources file at path.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read config: %w", err)
+	}
+
+	return ParseConfig(data)
+}
+
+// ParseConfig parses and validates a sources file from memory.
+func ParseConfig(data []byte) (*Config, error) {
+	var cfg Config
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("couldn't parse config: %w", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// Validate checks the config for mistakes that would stop it from being
+// applied, such as missing locations or duplicate names.
+func (c *Config) Validate() error {
+	if c.Interval < 0 {
+		return fmt.Errorf("invalid config: negative interval")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("invalid config: negative timeout")
+	}
+	if err := checkLabels(c.Labels, c.LabelPatterns); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	if _, err := NewRelabeler(c.MetricRelabelConfigs); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	if _, err := NewDSFilter(c.IncludeDS, c.ExcludeDS); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	if _, err := NewTransformer(c.Transforms); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	for _, src := range c.Sources {
+		if err := checkLabels(src.Labels, src.LabelPatterns); err != nil {
+			return fmt.Errorf("invalid config: source %s: %w", src.Location, err)
+		}
+		if _, err := NewRelabeler(src.MetricRelabelConfigs); err != nil {
+			return fmt.Errorf("invalid config: source %s: %w", src.Location, err)
+		}
+		if _, err := NewDSFilter(src.IncludeDS, src.ExcludeDS); err != nil {
+			return fmt.Errorf("invalid config: source %s: %w", src.Location, err)
+		}
+		if _, err := NewTransformer(src.Transforms); err != nil {
+			return fmt.Errorf("invalid config: source %s: %w", src.Location, err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, src := range c.resolvedSources() {
+		if src.Location == "" {
+			return fmt.Errorf("invalid config: source %d has no location", i)
+		}
+		if src.Interval < 0 {
+			return fmt.Errorf("invalid config: source %s has a negative interval", src.Name)
+		}
+		if src.Timeout < 0 {
+			return fmt.Errorf("invalid config: source %s has a negative timeout", src.Name)
+		}
+		if seen[src.Name] {
+			return fmt.Errorf("invalid config: duplicate source name %s", src.Name)
+		}
+		seen[src.Name] = true
+	}
+
+	return nil
+}
+
+// checkLabels makes sure static labels and label patterns are usable
+func checkLabels(labels map[string]string, patterns []string) error {
+	for name := range labels {
+		if err := checkLabelName(name); err != nil {
+			return err
+		}
+	}
+	for _, pattern := range patterns {
+		if _, err := compileLabelPattern(pattern); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolvedSources returns the sources with all defaults filled in, so two
+// resolved sources compare equal only if they'd behave the same. Labels
+// end up holding every label of the source: the global ones, then the
+// ones captured by the global and the source's patterns, then the
+// source's own, each overriding the one before. MetricRelabelConfigs
+// holds the global rules followed by the source's, and ExcludeDS the
+// global regexes followed by the source's. Transforms holds the global
+// transforms with the source's on top.
+func (c *Config) resolvedSources() []SourceConfig {
+	globalPatterns := compileLabelPatterns(c.LabelPatterns)
+
+	sources := make([]SourceConfig, 0, len(c.Sources))
+	for _, src := range c.Sources {
+		labels := make(map[string]string)
+		for name, value := range c.Labels {
+			labels[name] = value
+		}
+		extractLabels(globalPatterns, src.Location, labels)
+		extractLabels(compileLabelPatterns(src.LabelPatterns), src.Location, labels)
+		for name, value := range src.Labels {
+			labels[name] = value
+		}
+		src.Labels = labels
+		src.LabelPatterns = nil
+
+		if len(c.MetricRelabelConfigs) > 0 {
+			rules := make([]RelabelConfig, 0, len(c.MetricRelabelConfigs)+len(src.MetricRelabelConfigs))
+			rules = append(rules, c.MetricRelabelConfigs...)
+			src.MetricRelabelConfigs = append(rules, src.MetricRelabelConfigs...)
+		}
+
+		if len(src.IncludeDS) == 0 {
+			src.IncludeDS = c.IncludeDS
+		}
+		if len(c.ExcludeDS) > 0 {
+			exclude := make([]string, 0, len(c.ExcludeDS)+len(src.ExcludeDS))
+			exclude = append(exclude, c.ExcludeDS...)
+			src.ExcludeDS = append(exclude, src.ExcludeDS...)
+		}
+
+		if len(c.Transforms) > 0 {
+			transforms := make(map[string]TransformConfig, len(c.Transforms)+len(src.Transforms))
+			for ds, tr := range c.Transforms {
+				transforms[ds] = tr
+			}
+			for ds, tr := range src.Transforms {
+				transforms[ds] = tr
+			}
+			src.Transforms = transforms
+		}
+
+		if src.Name == "" {
+			base := filepath.Base(src.Location)
+			src.Name = strings.TrimSuffix(base, filepath.Ext(base))
+		}
+		if src.Interval == 0 {
+			src.Interval = c.Interval
+		}
+		if src.Timeout == 0 {
+			src.Timeout = c.Timeout
+		}
+		sources = append(sources, src)
+	}
+
+	return sources
+}
+
+// compileLabelPatterns compiles patterns, skipping any that are invalid
+// since Validate has already complained about them
+func compileLabelPatterns(patterns []string) []*regexp.Regexp {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		if re, err := compileLabelPattern(pattern); err == nil {
+			compiled = append(compiled, re)
+		}
+	}
+
+	return compiled
+}
+
+// open creates the RRDFile described by a resolved source, reading it
+// first unless read is false, see NewUnreadRRDFile.
+func (s SourceConfig) open(read bool) (*RRDFile, error) {
+	ctx := context.Background()
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(s.Timeout))
+		defer cancel()
+	}
+
+	var filter *DSFilter
+	if len(s.IncludeDS) > 0 || len(s.ExcludeDS) > 0 {
+		var err error
+		if filter, err = NewDSFilter(s.IncludeDS, s.ExcludeDS); err != nil {
+			return nil, err
+		}
+	}
+
+	rrdFile := NewUnreadRRDFile(s.Location, s.Name, filter)
+	var err error
+	if read {
+		if rrdFile, err = NewFilteredRRDFile(ctx, s.Location, s.Name, filter); err != nil {
+			return nil, err
+		}
+	}
+	rrdFile.Timeout = time.Duration(s.Timeout)
+	if len(s.Labels) > 0 {
+		rrdFile.Labels = s.Labels
+	}
+	if len(s.Transforms) > 0 {
+		if rrdFile.Transform, err = NewTransformer(s.Transforms); err != nil {
+			return nil, err
+		}
+	}
+	if len(s.MetricRelabelConfigs) > 0 {
+		if rrdFile.Relabel, err = NewRelabeler(s.MetricRelabelConfigs); err != nil {
+			return nil, err
+		}
+	}
+
+	// an explicit interval overrides the step read from the file
+	if s.Interval > 0 {
+		rrdFile.Interval = time.Duration(s.Interval)
+	}
+
+	return rrdFile, nil
+}
+
+// OpenSources sets up the RRD file of every source in c, carrying on
+// past the ones that can't be. It returns the files that were set up and
+// an error for each source that wasn't, for one-off runs that would
+// rather collect what they can than have ApplyConfig reject it all. The
+// files aren't read, so that CollectOnce reads each of them only once,
+// and a file that can't be read is reported by it.
+func (c *Config) OpenSources() ([]*RRDFile, []error) {
+	if err := c.Validate(); err != nil {
+		return nil, []error{err}
+	}
+
+	var files []*RRDFile
+	var errs []error
+	for _, src := range c.resolvedSources() {
+		rrdFile, err := src.open(false)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("source %s: %w", src.Name, err))
+			continue
+		}
+		files = append(files, rrdFile)
+	}
+
+	return files, errs
+}
+
+// ApplyConfig brings the set of managed files in line with cfg. Sources
+// that are new are added, sources no longer present are removed and
+// sources whose settings changed are restarted, while unchanged sources
+// keep running untouched.
+// The config is applied all or nothing: if it's invalid, or any new or
+// changed source can't be opened, an error is returned and the files
+// already running are left alone.
+func (m *RRDManager) ApplyConfig(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+
+	desired := make(map[string]SourceConfig)
+	for _, src := range cfg.resolvedSources() {
+		desired[src.Name] = src
+	}
+
+	// open everything that needs (re)starting before touching any of the
+	// running handlers, so a bad source rejects the whole config. sources
+	// that were given up on after failing are started again too
+	opened := make(map[string]*RRDFile)
+	for name, src := range desired {
+		if current, exists := m.sources[name]; exists && reflect.DeepEqual(current, src) && m.manages(name) {
+			continue
+		}
+		rrdFile, err := src.open(true)
+		if err != nil {
+			return fmt.Errorf("couldn't apply config: source %s: %w", name, err)
+		}
+		opened[name] = rrdFile
+	}
+
+	for name := range m.sources {
+		if _, exists := desired[name]; !exists {
+			// the file may already have been removed by hand, which
+			// leaves us where we wanted to be anyway
+			m.Remove(name)
+		}
+	}
+
+	for _, rrdFile := range opened {
+		if err := m.Replace(rrdFile); err != nil {
+			return err
+		}
+	}
+
+	m.sources = desired
+
+	return nil
+}
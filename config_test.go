@@ -0,0 +1,235 @@
+package rrd2prom_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jessegalley/rrd2prom"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := rrd2prom.LoadConfig("testdata/sources.yaml")
+	require.NoError(t, err)
+
+	require.Len(t, cfg.Sources, 1)
+	assert.Equal(t, "testdata/port1.rrd", cfg.Sources[0].Location)
+	assert.Equal(t, "eth1/24", cfg.Sources[0].Name)
+	assert.Equal(t, rrd2prom.Duration(60*time.Second), cfg.Sources[0].Interval)
+	assert.Equal(t, rrd2prom.Duration(10*time.Second), cfg.Sources[0].Timeout)
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{"Empty", "", false},
+		{"DurationString", "interval: 1m30s\nsources:\n - location: a.rrd\n", false},
+		{"MissingLocation", "sources:\n - name: a\n", true},
+		{"DuplicateNames", "sources:\n - location: a.rrd\n - location: other/a.rrd\n", true},
+		{"NegativeInterval", "sources:\n - location: a.rrd\n   interval: -1\n", true},
+		{"NegativeTimeout", "timeout: -5s\nsources:\n - location: a.rrd\n", true},
+		{"UnknownField", "sources:\n - location: a.rrd\n   bogus: 1\n", true},
+		{"BadDuration", "interval: soon\n", true},
+		{"Labels", "labels: {site: ams}\nlabel_patterns: ['(?P<host>[^_]+)_']\nsources:\n - location: a.rrd\n   labels: {device: sw1}\n", false},
+		{"BadLabelName", "labels: {1site: ams}\n", true},
+		{"ReservedLabel", "sources:\n - location: a.rrd\n   labels: {file: x}\n", true},
+		{"InternalLabel", "labels: {__site: ams}\n", true},
+		{"InternalLabelPattern", "label_patterns: ['(?P<__host>[^_]+)_']\n", true},
+		{"BadLabelPattern", "label_patterns: ['(?P<host>']\n", true},
+		{"Relabel", "metric_relabel_configs:\n - source_labels: [__ds__]\n   regex: unused\n   action: drop\nsources:\n - location: a.rrd\n   metric_relabel_configs:\n    - regex: site\n      action: labeldrop\n", false},
+		{"BadRelabelAction", "metric_relabel_configs:\n - action: mangle\n", true},
+		{"BadSourceRelabel", "sources:\n - location: a.rrd\n   metric_relabel_configs:\n    - action: replace\n", true},
+		{"DSFilter", "include_ds: ['traffic_.*']\nsources:\n - location: a.rrd\n   exclude_ds: [traffic_err]\n", false},
+		{"BadIncludeDS", "include_ds: ['(traffic']\n", true},
+		{"BadSourceExcludeDS", "sources:\n - location: a.rrd\n   exclude_ds: ['[']\n", true},
+		{"Transforms", "transforms:\n  traffic_in: {multiply: 8, unit: bits}\nsources:\n - location: a.rrd\n   transforms:\n     total: {expr: traffic_in + traffic_out}\n", false},
+		{"BadTransformExpr", "sources:\n - location: a.rrd\n   transforms:\n     total: {expr: 'traffic_in +'}\n", true},
+		{"UnnamedLabelPattern", "sources:\n - location: a.rrd\n   label_patterns: ['([^_]+)_']\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := rrd2prom.ParseConfig([]byte(tt.config))
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// writeConfig writes a sources file into a temp dir and loads it
+func writeConfig(t *testing.T, config string) *rrd2prom.Config {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "sources.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(config), 0644))
+
+	cfg, err := rrd2prom.LoadConfig(path)
+	require.NoError(t, err)
+
+	return cfg
+}
+
+// filesByName indexes the manager's current files by name
+func filesByName(m *rrd2prom.RRDManager) map[string]*rrd2prom.RRDFile {
+	files := make(map[string]*rrd2prom.RRDFile)
+	for _, f := range m.Files() {
+		files[f.Name] = f
+	}
+	return files
+}
+
+func TestRRDManager_ApplyConfig(t *testing.T) {
+	fakes := newFakeRRDs(t)
+	fakes.set("a.rrd", 1735589344, 1)
+	fakes.set("b.rrd", 1735589344, 2)
+	fakes.set("c.rrd", 1735589344, 3)
+
+	m, sink := newManager(t, nil)
+	startManager(t, m, sink)
+
+	require.NoError(t, m.ApplyConfig(writeConfig(t, `
+interval: 30
+sources:
+ - location: a.rrd
+ - location: b.rrd
+   interval: 10
+`)))
+
+	before := filesByName(m)
+	require.Len(t, before, 2)
+	assert.Equal(t, 30*time.Second, before["a"].Interval)
+	assert.Equal(t, 10*time.Second, before["b"].Interval)
+
+	// b changes interval, c is new and a is untouched
+	require.NoError(t, m.ApplyConfig(writeConfig(t, `
+interval: 30
+sources:
+ - location: a.rrd
+ - location: b.rrd
+   interval: 20
+ - location: c.rrd
+`)))
+
+	after := filesByName(m)
+	require.Len(t, after, 3)
+	assert.Same(t, before["a"], after["a"])
+	assert.NotSame(t, before["b"], after["b"])
+	assert.Equal(t, 20*time.Second, after["b"].Interval)
+
+	// dropping a source stops it
+	require.NoError(t, m.ApplyConfig(writeConfig(t, `
+interval: 30
+sources:
+ - location: b.rrd
+   interval: 20
+ - location: c.rrd
+`)))
+	assert.NotContains(t, filesByName(m), "a")
+	assert.Len(t, m.Files(), 2)
+}
+
+func TestRRDManager_ApplyConfigLabels(t *testing.T) {
+	fakes := newFakeRRDs(t)
+	fakes.set("rra/core1_traffic_in_12.rrd", 1735589344, 1)
+	fakes.set("rra/core2_traffic_in_7.rrd", 1735589344, 2)
+
+	m, err := rrd2prom.NewRRDManager(nil)
+	require.NoError(t, err)
+
+	// global labels, then captured ones, then the source's own
+	require.NoError(t, m.ApplyConfig(writeConfig(t, `
+labels:
+  site: ams
+  role: edge
+label_patterns:
+ - 'rra/(?P<host>[^_]+)_traffic_in_(?P<id>\d+)\.rrd'
+sources:
+ - location: rra/core1_traffic_in_12.rrd
+   name: core1
+   labels:
+     role: core
+ - location: rra/core2_traffic_in_7.rrd
+   name: core2
+   label_patterns:
+    - '_(?P<direction>in|out)_'
+`)))
+
+	files := filesByName(m)
+	assert.Equal(t, map[string]string{"site": "ams", "role": "core", "host": "core1", "id": "12"}, files["core1"].Labels)
+	assert.Equal(t, map[string]string{"site": "ams", "role": "edge", "host": "core2", "id": "7", "direction": "in"}, files["core2"].Labels)
+}
+
+func TestConfig_OpenSources(t *testing.T) {
+	fakes := newFakeRRDs(t)
+	fakes.set("a.rrd", 1735589344, 1)
+	fakes.set("c.rrd", 1735589344, 3)
+
+	// nothing is read yet, so the missing file only shows up when the
+	// files are collected
+	files, errs := writeConfig(t, `
+sources:
+ - location: a.rrd
+ - location: missing.rrd
+ - location: c.rrd
+`).OpenSources()
+	assert.Empty(t, errs)
+	require.Len(t, files, 3)
+	for _, file := range files {
+		assert.True(t, file.Snapshot().LastUpdate.IsZero(), file.Name)
+	}
+
+	events := newEventRecorder()
+	store := rrd2prom.NewStore()
+	m, err := rrd2prom.NewRRDManager(files,
+		events.option(),
+		rrd2prom.WithSink(store, rrd2prom.SinkOptions{Name: "store", Policy: rrd2prom.SinkBlock}),
+	)
+	require.NoError(t, err)
+
+	// and doesn't stop the others, whose first read isn't a schema change
+	err = m.CollectOnce(context.Background())
+	assert.ErrorIs(t, err, rrd2prom.ErrNotFound)
+	assert.ErrorContains(t, err, "source missing")
+	assert.Len(t, store.Metrics(), 2)
+	assert.Equal(t, time.Minute, files[0].Snapshot().Interval)
+	var seen []rrd2prom.Event
+	for len(events.events) > 0 {
+		seen = append(seen, <-events.events)
+	}
+	assert.Equal(t, 2, countType(seen, rrd2prom.EventUpdateOK))
+	assert.Zero(t, countType(seen, rrd2prom.EventSchemaChanged))
+
+	files, errs = (&rrd2prom.Config{Sources: []rrd2prom.SourceConfig{{Name: "x"}}}).OpenSources()
+	assert.Empty(t, files)
+	assert.Len(t, errs, 1)
+}
+
+func TestRRDManager_ApplyConfigRejected(t *testing.T) {
+	fakes := newFakeRRDs(t)
+	fakes.set("a.rrd", 1735589344, 1)
+
+	m, err := rrd2prom.NewRRDManager(nil)
+	require.NoError(t, err)
+	require.NoError(t, m.ApplyConfig(writeConfig(t, "sources:\n - location: a.rrd\n")))
+	before := filesByName(m)
+
+	// a source that can't be opened rejects the whole config
+	err = m.ApplyConfig(writeConfig(t, "sources:\n - location: missing.rrd\n"))
+	assert.Error(t, err)
+
+	// as does an invalid one
+	err = m.ApplyConfig(&rrd2prom.Config{Sources: []rrd2prom.SourceConfig{{Name: "x"}}})
+	assert.Error(t, err)
+
+	assert.Equal(t, before, filesByName(m))
+}
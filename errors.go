@@ -0,0 +1,111 @@
+package rrd2prom
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when an RRD file doesn't exist, either on disk or
+// as a 404 from its URL.
+var ErrNotFound = errors.New("rrd file not found")
+
+// ErrCorrupt is returned when librrd couldn't read an RRD file that's
+// there, like a truncated file or an error page served in place of it.
+var ErrCorrupt = errors.New("rrd file unreadable")
+
+// ErrSchemaChanged is matched by a *SchemaChange, which describes how an
+// RRD file's data sources or step no longer match the ones it was last
+// read with.
+var ErrSchemaChanged = errors.New("rrd schema changed")
+
+// ErrNameCollision is reported when a metric would have the same name and
+// labels as another one, see Namer.
+var ErrNameCollision = errors.New("metric name collision")
+
+// FetchError is returned when an RRD file couldn't be downloaded from its
+// URL. StatusCode is zero if no response was received at all, in which
+// case Err holds the underlying error.
+type FetchError struct {
+	URL        string
+	StatusCode int
+	Err        error
+}
+
+func (e *FetchError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("couldn't fetch %s: bad status: %d %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("couldn't fetch %s: %v", e.URL, e.Err)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes a 404 match ErrNotFound.
+func (e *FetchError) Is(target error) bool {
+	return target == ErrNotFound && e.StatusCode == http.StatusNotFound
+}
+
+// ParseError is returned when a field of an RRD file's metadata is missing
+// or malformed. Field is the rrd info key, like "step" or "ds.last_ds".
+type ParseError struct {
+	Location string
+	Field    string
+	Err      error
+}
+
+func (e *ParseError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("couldn't parse %s from %s: %v", e.Field, e.Location, e.Err)
+	}
+	return fmt.Sprintf("couldn't parse %s from %s", e.Field, e.Location)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// SchemaChange describes how an RRD file's metadata changed since it was
+// last read, usually because of an `rrdtool tune`. It isn't a failure:
+// Update still succeeds and switches the file over to the new schema,
+// the change is reported by LastSchemaChange and EventSchemaChanged.
+type SchemaChange struct {
+	Location string
+	Added    []string // data sources that appeared
+	Removed  []string // data sources that went away
+	Retyped  []string // data sources whose type changed
+	OldStep  time.Duration
+	NewStep  time.Duration
+}
+
+func (c *SchemaChange) Error() string {
+	return fmt.Sprintf("%v: %s: %s", ErrSchemaChanged, c.Location, c.describe())
+}
+
+// Is makes a SchemaChange match ErrSchemaChanged.
+func (c *SchemaChange) Is(target error) bool {
+	return target == ErrSchemaChanged
+}
+
+// describe lists what changed, like "added [a b], step 1m0s -> 5m0s"
+func (c *SchemaChange) describe() string {
+	var parts []string
+	if len(c.Added) > 0 {
+		parts = append(parts, fmt.Sprintf("added %v", c.Added))
+	}
+	if len(c.Removed) > 0 {
+		parts = append(parts, fmt.Sprintf("removed %v", c.Removed))
+	}
+	if len(c.Retyped) > 0 {
+		parts = append(parts, fmt.Sprintf("retyped %v", c.Retyped))
+	}
+	if c.OldStep != c.NewStep {
+		parts = append(parts, fmt.Sprintf("step %v -> %v", c.OldStep, c.NewStep))
+	}
+
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,237 @@
+package rrd2prom
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"time"
+)
+
+// EventType identifies what happened in an Event.
+type EventType int
+
+const (
+	EventManagerStarted EventType = iota
+	EventManagerStopped
+	EventHandlerStarted
+	EventHandlerStopped
+	EventUpdateOK
+	EventUpdateFailed
+	EventSinkFailed
+	EventCircuitOpened
+	EventCircuitClosed
+	EventSourceDropped
+	EventSchemaChanged
+	EventNameCollision
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventManagerStarted:
+		return "manager_started"
+	case EventManagerStopped:
+		return "manager_stopped"
+	case EventHandlerStarted:
+		return "handler_started"
+	case EventHandlerStopped:
+		return "handler_stopped"
+	case EventUpdateOK:
+		return "update_ok"
+	case EventUpdateFailed:
+		return "update_failed"
+	case EventSinkFailed:
+		return "sink_failed"
+	case EventCircuitOpened:
+		return "circuit_opened"
+	case EventCircuitClosed:
+		return "circuit_closed"
+	case EventSourceDropped:
+		return "source_dropped"
+	case EventSchemaChanged:
+		return "schema_changed"
+	case EventNameCollision:
+		return "name_collision"
+	}
+	return "unknown"
+}
+
+// Event describes something that happened inside an RRDManager. File and
+// Location are empty for manager wide events, Duration is only set for
+// updates, Sink only for sink failures, Schema only for schema changes and
+// Err/ErrKind only for failures and name collisions.
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	File     string
+	Location string
+	Sink     string
+	Duration time.Duration
+	Schema   *SchemaChange
+	Err      error
+	ErrKind  string
+}
+
+// eventBuffer is how many events can be queued for the event handler
+// before new ones start getting dropped.
+const eventBuffer = 1024
+
+// Option configures optional RRDManager behaviour.
+type Option func(*RRDManager)
+
+// WithEventHandler has the manager call fn for every Event. fn is called
+// from a single goroutine owned by the manager, never from the collection
+// loop itself, so a slow fn can't stall collection; if it falls too far
+// behind events are dropped instead (see DroppedEvents).
+func WithEventHandler(fn func(Event)) Option {
+	return func(m *RRDManager) {
+		m.onEvent = append(m.onEvent, fn)
+	}
+}
+
+// WithLogger logs every Event to logger, see LogEvent.
+func WithLogger(logger *slog.Logger) Option {
+	return WithEventHandler(func(e Event) {
+		LogEvent(logger, e)
+	})
+}
+
+// LogEvent writes e to logger. Successful updates are logged at debug
+// level since there's one per file per interval, failures at warn, sources
+// being given up on at error and everything else at info.
+func LogEvent(logger *slog.Logger, e Event) {
+	level := slog.LevelInfo
+	attrs := []slog.Attr{slog.String("event", e.Type.String())}
+
+	if e.File != "" {
+		attrs = append(attrs, slog.String("file", e.File))
+	}
+	if e.Location != "" {
+		attrs = append(attrs, slog.String("location", e.Location))
+	}
+	if e.Sink != "" {
+		attrs = append(attrs, slog.String("sink", e.Sink))
+	}
+	if e.Duration > 0 {
+		attrs = append(attrs, slog.Duration("duration", e.Duration))
+	}
+	if e.Schema != nil {
+		attrs = append(attrs, slog.String("change", e.Schema.describe()))
+	}
+	if e.Err != nil {
+		attrs = append(attrs, slog.String("kind", e.ErrKind), slog.Any("error", e.Err))
+	}
+
+	switch e.Type {
+	case EventUpdateOK:
+		level = slog.LevelDebug
+	case EventUpdateFailed, EventSinkFailed, EventCircuitOpened, EventSchemaChanged, EventNameCollision:
+		level = slog.LevelWarn
+	case EventSourceDropped:
+		level = slog.LevelError
+	}
+
+	logger.LogAttrs(context.Background(), level, e.Type.String(), attrs...)
+}
+
+// errorKind sorts err into a short, stable label for events.
+func errorKind(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, ErrNotFound):
+		return "not_found"
+	case errors.Is(err, fs.ErrPermission):
+		return "permission"
+	case errors.Is(err, ErrCorrupt):
+		return "corrupt"
+	case errors.Is(err, ErrSchemaChanged):
+		return "schema_changed"
+	case errors.Is(err, ErrNameCollision):
+		return "name_collision"
+	}
+
+	var fetchErr *FetchError
+	if errors.As(err, &fetchErr) {
+		return "fetch"
+	}
+	var parseErr *ParseError
+	if errors.As(err, &parseErr) {
+		return "parse"
+	}
+
+	return "unknown"
+}
+
+// emit queues an event for the event handlers without ever blocking, if
+// the queue is full the event is counted as dropped.
+func (m *RRDManager) emit(e Event) {
+	if len(m.onEvent) == 0 {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.Err != nil && e.ErrKind == "" {
+		e.ErrKind = errorKind(e.Err)
+	}
+
+	m.eventsMu.RLock()
+	defer m.eventsMu.RUnlock()
+
+	// nobody's listening while the manager isn't running
+	if m.events == nil || m.eventsClosed {
+		return
+	}
+
+	select {
+	case m.events <- e:
+	default:
+		m.droppedEvents.Add(1)
+	}
+}
+
+// startEvents starts the dispatcher for a new run of the manager.
+func (m *RRDManager) startEvents() {
+	m.eventsMu.Lock()
+	defer m.eventsMu.Unlock()
+
+	m.events = make(chan Event, eventBuffer)
+	m.eventsDone = make(chan struct{})
+	m.eventsClosed = false
+	go dispatchEvents(m.events, m.eventsDone, m.onEvent)
+}
+
+// closeEvents stops queueing events and waits for the dispatcher to hand
+// out the ones already queued.
+func (m *RRDManager) closeEvents() {
+	m.eventsMu.Lock()
+	m.eventsClosed = true
+	close(m.events)
+	m.eventsMu.Unlock()
+
+	<-m.eventsDone
+}
+
+// dispatchEvents feeds queued events to the event handlers until the
+// events channel is closed.
+func dispatchEvents(events <-chan Event, done chan<- struct{}, onEvent []func(Event)) {
+	defer close(done)
+
+	for e := range events {
+		for _, fn := range onEvent {
+			fn(e)
+		}
+	}
+}
+
+// DroppedEvents returns how many events were thrown away because the event
+// handlers couldn't keep up.
+func (m *RRDManager) DroppedEvents() uint64 {
+	return m.droppedEvents.Load()
+}
@@ -0,0 +1,36 @@
+package rrd2prom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorKind(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, ""},
+		{context.Canceled, "canceled"},
+		{fmt.Errorf("couldn't read: %w", context.DeadlineExceeded), "timeout"},
+		{fmt.Errorf("%w: port1.rrd", ErrNotFound), "not_found"},
+		{&FetchError{URL: "http://nms1/port1.rrd", StatusCode: http.StatusNotFound}, "not_found"},
+		{&fs.PathError{Op: "open", Path: "port1.rrd", Err: fs.ErrPermission}, "permission"},
+		{fmt.Errorf("%w: port1.rrd: %w", ErrCorrupt, errors.New("read: unexpected end of file")), "corrupt"},
+		{&SchemaChange{Location: "port1.rrd", Added: []string{"traffic_out"}}, "schema_changed"},
+		{fmt.Errorf("%w: rrd_traffic_in", ErrNameCollision), "name_collision"},
+		{&FetchError{URL: "http://nms1/port1.rrd", StatusCode: http.StatusBadGateway}, "fetch"},
+		{&ParseError{Location: "port1.rrd", Field: "step"}, "parse"},
+		{errors.New("something else"), "unknown"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, errorKind(tt.err), "%v", tt.err)
+	}
+}
@@ -0,0 +1,10 @@
+package rrd2prom
+
+// SetRRDInfo swaps out the function used to read RRD metadata so tests
+// can run against canned info maps. The returned func restores the
+// original.
+func SetRRDInfo(fn func(string) (map[string]interface{}, error)) (restore func()) {
+	orig := rrdInfo
+	rrdInfo = fn
+	return func() { rrdInfo = orig }
+}
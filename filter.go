@@ -0,0 +1,69 @@
+package rrd2prom
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// DSFilter picks which data sources of an RRD file are read. Data sources
+// it rejects are skipped while parsing, so they never show up in
+// DataSources or as metrics.
+type DSFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// NewDSFilter creates a DSFilter from lists of regexes, which have to
+// match the whole data source name. With any include regexes a data
+// source has to match one of them, and it mustn't match any of the
+// exclude regexes.
+func NewDSFilter(include, exclude []string) (*DSFilter, error) {
+	var f DSFilter
+	var err error
+	if f.include, err = compileDSPatterns(include); err != nil {
+		return nil, fmt.Errorf("invalid include_ds: %w", err)
+	}
+	if f.exclude, err = compileDSPatterns(exclude); err != nil {
+		return nil, fmt.Errorf("invalid exclude_ds: %w", err)
+	}
+
+	return &f, nil
+}
+
+// compileDSPatterns compiles patterns anchored at both ends
+func compileDSPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+
+	return compiled, nil
+}
+
+// Match reports whether the data source called name should be read. A
+// nil DSFilter matches everything.
+func (f *DSFilter) Match(name string) bool {
+	if f == nil {
+		return true
+	}
+
+	for _, re := range f.exclude {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, re := range f.include {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+
+	return false
+}
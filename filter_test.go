@@ -0,0 +1,80 @@
+package rrd2prom_test
+
+import (
+	"testing"
+
+	"github.com/jessegalley/rrd2prom"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDSFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		want    map[string]bool
+	}{
+		{"Empty", nil, nil, map[string]bool{"traffic_in": true, "load": true}},
+		{"Include", []string{"traffic_.*"}, nil, map[string]bool{"traffic_in": true, "traffic_out": true, "load": false}},
+		{"Anchored", []string{"traffic"}, nil, map[string]bool{"traffic": true, "traffic_in": false}},
+		{"Exclude", nil, []string{"load", "temp_.*"}, map[string]bool{"traffic_in": true, "load": false, "temp_1": false}},
+		{"ExcludeWins", []string{"traffic_.*"}, []string{".*_out"}, map[string]bool{"traffic_in": true, "traffic_out": false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := rrd2prom.NewDSFilter(tt.include, tt.exclude)
+			require.NoError(t, err)
+			for ds, want := range tt.want {
+				assert.Equal(t, want, f.Match(ds), ds)
+			}
+		})
+	}
+
+	_, err := rrd2prom.NewDSFilter([]string{"(traffic"}, nil)
+	assert.Error(t, err)
+
+	var nilFilter *rrd2prom.DSFilter
+	assert.True(t, nilFilter.Match("anything"))
+}
+
+func TestRRDManager_ApplyConfigDSFilter(t *testing.T) {
+	fakes := newFakeRRDs(t)
+	for _, location := range []string{"ups1.rrd", "ups2.rrd"} {
+		fakes.set(location, 1735589344, 1)
+		fakes.mu.Lock()
+		fakes.infos[location]["ds.index"] = map[string]interface{}{"charge": uint(0), "load": uint(1), "temp": uint(2)}
+		fakes.infos[location]["ds.type"] = map[string]interface{}{"charge": "GAUGE", "load": "GAUGE", "temp": "GAUGE"}
+		// excluded data sources aren't parsed at all, so a bad value in
+		// one of them doesn't matter
+		fakes.infos[location]["ds.last_ds"] = map[string]interface{}{"charge": "98", "load": "12", "temp": "bogus"}
+		fakes.mu.Unlock()
+	}
+
+	m, err := rrd2prom.NewRRDManager(nil)
+	require.NoError(t, err)
+
+	require.NoError(t, m.ApplyConfig(writeConfig(t, `
+include_ds: [charge, load]
+exclude_ds: [temp]
+sources:
+ - location: ups1.rrd
+ - location: ups2.rrd
+   include_ds: ['.*']
+   exclude_ds: [load]
+`)))
+
+	files := filesByName(m)
+	assert.ElementsMatch(t, []string{"charge", "load"}, keys(files["ups1"].DataSources))
+	assert.ElementsMatch(t, []string{"charge"}, keys(files["ups2"].DataSources))
+}
+
+// keys returns the keys of a data source map
+func keys(m map[string]rrd2prom.RRDDataSource) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	return names
+}
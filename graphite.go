@@ -0,0 +1,198 @@
+package rrd2prom
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultGraphitePath is the default template for Graphite paths. The
+// values of labels the file doesn't have go at the end, so metrics of
+// the same name, like those of rrd_rra_info, each get a path of their
+// own.
+const DefaultGraphitePath = "{{.File}}.{{.Name}}{{range .LabelValues}}.{{.}}{{end}}"
+
+// GraphiteOptions configures a GraphiteSink. Address is required.
+type GraphiteOptions struct {
+	// Address is the host:port of Graphite's plaintext listener, usually
+	// on port 2003
+	Address string
+	// Path is a path template for metric paths, see NewPathTemplate.
+	// Defaults to DefaultGraphitePath
+	Path string
+	// Buffer is how many lines are kept while Graphite can't be reached,
+	// defaults to 100000
+	Buffer int
+	// Timeout bounds connecting and each write, defaults to 10s
+	Timeout time.Duration
+}
+
+// GraphiteSink is a Sink that writes metrics to Graphite's plaintext
+// protocol over TCP, one "path value timestamp" line each, timestamped
+// with the file's last update. The values going into a path have
+// anything Graphite doesn't like in a path node, dots included, replaced
+// with _, so a file called eth1/24 can't add levels to the tree. Unknown
+// values are left out since Graphite can't store them, and so are
+// metrics whose path another one in the same write already has, which
+// would otherwise overwrite each other, reporting them as an error.
+//
+// The connection is made on the first write and made again whenever
+// one fails. Lines that couldn't be written are kept and sent once it's
+// back, up to Buffer of them, after which the oldest are dropped, and
+// Close has a last go at sending them. Lines are written one at a time,
+// so a failed write can only have cut short the line it was writing.
+// That line is sent again in full, the part of it that made it out is
+// left unterminated on the old connection, where Graphite throws it away.
+type GraphiteSink struct {
+	opts GraphiteOptions
+	path *PathTemplate
+
+	// mu guards conn and buf, and keeps writes in order
+	mu   sync.Mutex
+	conn net.Conn
+	buf  lineBuffer
+}
+
+// NewGraphiteSink creates a GraphiteSink, checking its options. It
+// doesn't connect until the first write.
+func NewGraphiteSink(opts GraphiteOptions) (*GraphiteSink, error) {
+	if _, _, err := net.SplitHostPort(opts.Address); err != nil {
+		return nil, fmt.Errorf("invalid Graphite address %q: %w", opts.Address, err)
+	}
+	if opts.Path == "" {
+		opts.Path = DefaultGraphitePath
+	}
+	path, err := NewPathTemplate(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Buffer <= 0 {
+		opts.Buffer = defaultLineBuffer
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+
+	return &GraphiteSink{opts: opts, path: path, buf: lineBuffer{size: opts.Buffer}}, nil
+}
+
+// WriteMetrics implements Sink.
+func (s *GraphiteSink) WriteMetrics(file string, metrics []Metric) error {
+	var errs []error
+	lines := make([]string, 0, len(metrics))
+	paths := make(map[string]struct{}, len(metrics))
+	for _, metric := range metrics {
+		if math.IsNaN(metric.Value) || math.IsInf(metric.Value, 0) {
+			continue
+		}
+		path, err := s.path.execute(metric, graphiteNode)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		path = strings.ReplaceAll(path, " ", "_")
+		if _, dup := paths[path]; dup {
+			errs = append(errs, fmt.Errorf("graphite path %s of %s is taken by another metric of %s", path, metric.Name, metric.File))
+			continue
+		}
+		paths[path] = struct{}{}
+
+		at := metric.LastUpdate
+		if at.IsZero() {
+			at = metric.Timestamp
+		}
+		lines = append(lines, path+" "+
+			strconv.FormatFloat(metric.Value, 'g', -1, 64)+" "+
+			strconv.FormatInt(at.Unix(), 10)+"\n")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.buf.add(lines)
+	errs = append(errs, s.buf.droppedErr("graphite"))
+	errs = append(errs, s.send(time.Time{}))
+
+	return errors.Join(errs...)
+}
+
+// send writes the buffered lines, connecting first if needed, giving up
+// at deadline if it's set. s.mu must be held by the caller.
+func (s *GraphiteSink) send(deadline time.Time) error {
+	if len(s.buf.lines) == 0 {
+		return nil
+	}
+
+	// each step gets Timeout, unless that runs past the deadline
+	until := func() time.Time {
+		at := time.Now().Add(s.opts.Timeout)
+		if !deadline.IsZero() && deadline.Before(at) {
+			return deadline
+		}
+		return at
+	}
+
+	if s.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.opts.Address, time.Until(until()))
+		if err != nil {
+			return fmt.Errorf("couldn't connect to graphite: %w, %d lines buffered", err, len(s.buf.lines))
+		}
+		s.conn = conn
+	}
+
+	for len(s.buf.lines) > 0 {
+		if err := s.conn.SetWriteDeadline(until()); err != nil {
+			return s.fail(err)
+		}
+		if _, err := io.WriteString(s.conn, s.buf.lines[0]); err != nil {
+			return s.fail(err)
+		}
+		s.buf.lines = s.buf.lines[1:]
+	}
+	s.buf.lines = nil
+
+	return nil
+}
+
+// fail drops the connection after err so the next write makes a new one
+func (s *GraphiteSink) fail(err error) error {
+	s.conn.Close()
+	s.conn = nil
+
+	return fmt.Errorf("couldn't write to graphite: %w, %d lines buffered", err, len(s.buf.lines))
+}
+
+// Close tries once more, for up to Timeout, to send the lines still
+// buffered and closes the connection to Graphite. Lines that still can't
+// be sent are kept for the next write, the sink can be written to
+// afterwards.
+func (s *GraphiteSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.send(time.Now().Add(s.opts.Timeout))
+	if s.conn != nil {
+		err = errors.Join(err, s.conn.Close())
+		s.conn = nil
+	}
+
+	return err
+}
+
+// graphiteNode makes s usable as a single node of a Graphite path
+func graphiteNode(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-', r == ':':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
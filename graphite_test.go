@@ -0,0 +1,179 @@
+package rrd2prom_test
+
+import (
+	"bufio"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jessegalley/rrd2prom"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// graphiteServer is a stand-in Graphite plaintext listener that hands
+// every line it receives to lines
+type graphiteServer struct {
+	net.Listener
+	lines chan string
+}
+
+func newGraphiteServer(t *testing.T, address string) *graphiteServer {
+	t.Helper()
+
+	l, err := net.Listen("tcp", address)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	g := &graphiteServer{Listener: l, lines: make(chan string, 100)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					g.lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+
+	return g
+}
+
+// next returns the next line the server received
+func (g *graphiteServer) next(t *testing.T) string {
+	t.Helper()
+
+	select {
+	case line := <-g.lines:
+		return line
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a line")
+		return ""
+	}
+}
+
+func TestGraphiteSink(t *testing.T) {
+	server := newGraphiteServer(t, "127.0.0.1:0")
+
+	sink, err := rrd2prom.NewGraphiteSink(rrd2prom.GraphiteOptions{
+		Address: server.Addr().String(),
+		Path:    "rrd.{{.Labels.site}}.{{.File}}.{{.DS}}",
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { sink.Close() })
+
+	updated := time.Unix(1735589344, 0)
+	require.NoError(t, sink.WriteMetrics("eth1/24", []rrd2prom.Metric{
+		{Name: "rrd_traffic_in", File: "eth1/24", Source: "traffic_in", Value: 42, Labels: map[string]string{"site": "ams.1"}, LastUpdate: updated},
+		{Name: "rrd_temp", File: "eth1/24", Source: "temp", Value: math.NaN(), LastUpdate: updated},
+		{Name: "rrd_load", File: "eth1/24", Source: "load", Value: 0.5, LastUpdate: updated},
+	}))
+
+	// dots and slashes in values don't add levels, unknown values are
+	// left out, and missing labels are empty
+	assert.Equal(t, "rrd.ams_1.eth1_24.traffic_in 42 1735589344", server.next(t))
+	assert.Equal(t, "rrd..eth1_24.load 0.5 1735589344", server.next(t))
+
+	for _, bad := range []rrd2prom.GraphiteOptions{
+		{Address: "no port"},
+		{Address: server.Addr().String(), Path: "{{.Nope}}"},
+	} {
+		_, err := rrd2prom.NewGraphiteSink(bad)
+		assert.Error(t, err)
+	}
+}
+
+func TestGraphiteSink_DefaultPath(t *testing.T) {
+	server := newGraphiteServer(t, "127.0.0.1:0")
+
+	sink, err := rrd2prom.NewGraphiteSink(rrd2prom.GraphiteOptions{Address: server.Addr().String()})
+	require.NoError(t, err)
+	t.Cleanup(func() { sink.Close() })
+
+	// relabeling made two metrics of the same name out of two data
+	// sources, only a label tells them apart
+	updated := time.Unix(1735589344, 0)
+	fileLabels := map[string]string{"site": "ams"}
+	require.NoError(t, sink.WriteMetrics("port1", []rrd2prom.Metric{
+		{Name: "interface_octets_total", File: "port1", Source: "traffic_in", Value: 1, Labels: map[string]string{"site": "ams", "direction": "in"}, FileLabels: fileLabels, LastUpdate: updated},
+		{Name: "interface_octets_total", File: "port1", Source: "traffic_out", Value: 2, Labels: map[string]string{"site": "ams", "direction": "out"}, FileLabels: fileLabels, LastUpdate: updated},
+		{Name: "rrd_load", File: "port1", Source: "load", Value: 0.5, Labels: fileLabels, FileLabels: fileLabels, LastUpdate: updated},
+	}))
+	assert.Equal(t, "port1.interface_octets_total.in 1 1735589344", server.next(t))
+	assert.Equal(t, "port1.interface_octets_total.out 2 1735589344", server.next(t))
+	assert.Equal(t, "port1.rrd_load 0.5 1735589344", server.next(t))
+
+	// a template that leaves the labels out can't keep them apart, the
+	// second is reported rather than overwriting the first
+	sink, err = rrd2prom.NewGraphiteSink(rrd2prom.GraphiteOptions{Address: server.Addr().String(), Path: "{{.File}}.{{.Name}}"})
+	require.NoError(t, err)
+	t.Cleanup(func() { sink.Close() })
+
+	err = sink.WriteMetrics("port1", []rrd2prom.Metric{
+		{Name: "interface_octets_total", File: "port1", Source: "traffic_in", Value: 1, Labels: map[string]string{"direction": "in"}, LastUpdate: updated},
+		{Name: "interface_octets_total", File: "port1", Source: "traffic_out", Value: 2, Labels: map[string]string{"direction": "out"}, LastUpdate: updated},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "port1.interface_octets_total")
+	assert.Equal(t, "port1.interface_octets_total 1 1735589344", server.next(t))
+	select {
+	case line := <-server.lines:
+		t.Fatalf("unexpected line %q", line)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestGraphiteSink_Reconnect(t *testing.T) {
+	// find a free port, and leave it closed for now
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := l.Addr().String()
+	l.Close()
+
+	sink, err := rrd2prom.NewGraphiteSink(rrd2prom.GraphiteOptions{Address: address, Timeout: time.Second})
+	require.NoError(t, err)
+	t.Cleanup(func() { sink.Close() })
+
+	metric := rrd2prom.Metric{Name: "rrd_traffic_in", File: "port1", Value: 1, LastUpdate: time.Unix(60, 0)}
+	err = sink.WriteMetrics("port1", []rrd2prom.Metric{metric})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "1 lines buffered")
+
+	// once Graphite is back, the buffered line goes out first
+	server := newGraphiteServer(t, address)
+	metric.LastUpdate = time.Unix(120, 0)
+	require.NoError(t, sink.WriteMetrics("port1", []rrd2prom.Metric{metric}))
+	assert.Equal(t, "port1.rrd_traffic_in 1 60", server.next(t))
+	assert.Equal(t, "port1.rrd_traffic_in 1 120", server.next(t))
+}
+
+func TestGraphiteSink_Close(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := l.Addr().String()
+	l.Close()
+
+	sink, err := rrd2prom.NewGraphiteSink(rrd2prom.GraphiteOptions{Address: address, Timeout: time.Second})
+	require.NoError(t, err)
+
+	metric := rrd2prom.Metric{Name: "rrd_traffic_in", File: "port1", Value: 1, LastUpdate: time.Unix(60, 0)}
+	require.Error(t, sink.WriteMetrics("port1", []rrd2prom.Metric{metric}))
+
+	// closing has a last go at sending what's buffered
+	server := newGraphiteServer(t, address)
+	require.NoError(t, sink.Close())
+	assert.Equal(t, "port1.rrd_traffic_in 1 60", server.next(t))
+
+	// and the sink carries on afterwards
+	metric.LastUpdate = time.Unix(120, 0)
+	require.NoError(t, sink.WriteMetrics("port1", []rrd2prom.Metric{metric}))
+	assert.Equal(t, "port1.rrd_traffic_in 1 120", server.next(t))
+	require.NoError(t, sink.Close())
+}
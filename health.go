@@ -0,0 +1,206 @@
+package rrd2prom
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of a source's circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed is a healthy source, read on its normal schedule.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen is a source that kept failing and is only read again
+	// once its backoff runs out.
+	CircuitOpen
+	// CircuitHalfOpen is an open source that is being probed to see if
+	// it has recovered.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half_open"
+	}
+	return "unknown"
+}
+
+// defaults for failure handling, see WithBackoff and WithCircuitBreaker
+const (
+	defaultMaxBackoff       = 10 * time.Minute
+	defaultFailureThreshold = 5
+)
+
+// WithBackoff caps how far apart reads of a failing source can get. After
+// each consecutive failure the wait until the next read doubles, starting
+// from the source's interval, until it reaches max.
+func WithBackoff(max time.Duration) Option {
+	return func(m *RRDManager) {
+		if max > 0 {
+			m.sched.maxBackoff = max
+		}
+	}
+}
+
+// WithCircuitBreaker sets after how many consecutive failures a source's
+// circuit opens, and after how many it's given up on and removed from the
+// manager altogether. A maxFailures of zero never gives up.
+//
+// Only failures while the circuit is closed are reported as
+// EventUpdateFailed, after that a single EventCircuitOpened is sent and the
+// source stays quiet until it recovers, so a flapping source can't flood
+// the logs.
+func WithCircuitBreaker(threshold, maxFailures int) Option {
+	return func(m *RRDManager) {
+		if threshold > 0 {
+			m.failureThreshold = threshold
+		}
+		if maxFailures >= 0 {
+			m.maxFailures = maxFailures
+		}
+	}
+}
+
+// health tracks how reads of a single source have been going
+type health struct {
+	mu        sync.Mutex
+	state     CircuitState
+	failures  int   // consecutive failed reads
+	lastError error // error from the most recent failed read
+
+	// read is set once the first read finishes, see Ready
+	read bool
+
+	// instrumentation, see WriteSelfMetrics
+	lastSuccess time.Time
+}
+
+// SourceStatus is a point in time view of a source's health.
+type SourceStatus struct {
+	Name      string
+	Location  string
+	State     CircuitState
+	Failures  int
+	LastError error
+}
+
+// runHandler collects h and updates its health, returning false once the
+// source has failed often enough to be given up on.
+func (m *RRDManager) runHandler(h *handler) bool {
+	h.health.mu.Lock()
+	if h.health.state == CircuitOpen {
+		h.health.state = CircuitHalfOpen
+	}
+	h.health.mu.Unlock()
+
+	event := Event{File: h.file.Name, Location: h.file.Location}
+	event.Duration, event.Err = m.collect(h.ctx, h.file)
+
+	h.health.mu.Lock()
+	if event.Err == nil {
+		h.health.read = true
+		h.health.lastSuccess = time.Now()
+		m.counters.observe(h.file, event.Duration)
+		if h.health.state != CircuitClosed {
+			m.emit(Event{Type: EventCircuitClosed, File: h.file.Name, Location: h.file.Location})
+		}
+		h.health.state = CircuitClosed
+		h.health.failures = 0
+		h.health.lastError = nil
+		h.health.mu.Unlock()
+
+		event.Type = EventUpdateOK
+		m.emit(event)
+		return true
+	}
+
+	// a read cut short by the handler being stopped isn't the source's
+	// fault, don't count it
+	if h.ctx.Err() != nil {
+		h.health.mu.Unlock()
+		return true
+	}
+
+	h.health.read = true
+	h.health.failures++
+	h.health.lastError = event.Err
+	m.counters.observe(h.file, event.Duration)
+	m.updateErrors.add(errorKind(event.Err))
+
+	switch {
+	case h.health.state == CircuitClosed && h.health.failures < m.failureThreshold:
+		event.Type = EventUpdateFailed
+		m.emit(event)
+	case h.health.state == CircuitClosed:
+		event.Type = EventCircuitOpened
+		m.emit(event)
+		h.health.state = CircuitOpen
+	default:
+		h.health.state = CircuitOpen
+	}
+
+	giveUp := m.maxFailures > 0 && h.health.failures >= m.maxFailures
+	h.health.mu.Unlock()
+
+	if giveUp {
+		event.Type = EventSourceDropped
+		m.emit(event)
+		m.recordRunErr(fmt.Errorf("source %s dropped: %w", h.file.Name, event.Err))
+		m.dropHandler(h)
+		return false
+	}
+
+	return true
+}
+
+// dropHandler forgets about a handler that has been given up on. It's
+// called from the handler's own worker, so unlike Remove it can't wait for
+// the handler to finish.
+func (m *RRDManager) dropHandler(h *handler) {
+	m.mu.Lock()
+	if m.handlers[h.file.Name] == h {
+		delete(m.handlers, h.file.Name)
+	}
+	m.mu.Unlock()
+
+	h.cancel()
+	m.namer.release(h.file.Name)
+	m.rates.release(h.file.Name)
+	m.counters.release(h.file.Name)
+	m.forget(h.file.Name)
+}
+
+// SourceStatuses returns the health of every managed source, sorted by
+// name.
+func (m *RRDManager) SourceStatuses() []SourceStatus {
+	m.mu.Lock()
+	handlers := make([]*handler, 0, len(m.handlers))
+	for _, h := range m.handlers {
+		handlers = append(handlers, h)
+	}
+	m.mu.Unlock()
+
+	statuses := make([]SourceStatus, 0, len(handlers))
+	for _, h := range handlers {
+		h.health.mu.Lock()
+		statuses = append(statuses, SourceStatus{
+			Name:      h.file.Name,
+			Location:  h.file.Location,
+			State:     h.health.state,
+			Failures:  h.health.failures,
+			LastError: h.health.lastError,
+		})
+		h.health.mu.Unlock()
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	return statuses
+}
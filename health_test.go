@@ -0,0 +1,133 @@
+package rrd2prom_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/jessegalley/rrd2prom"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// eventRecorder collects events of the given types from a manager
+type eventRecorder struct {
+	events chan rrd2prom.Event
+}
+
+func newEventRecorder() *eventRecorder {
+	return &eventRecorder{events: make(chan rrd2prom.Event, 1000)}
+}
+
+func (r *eventRecorder) option() rrd2prom.Option {
+	return rrd2prom.WithEventHandler(func(e rrd2prom.Event) {
+		select {
+		case r.events <- e:
+		default:
+		}
+	})
+}
+
+// waitFor blocks until an event of type typ is seen, returning every
+// event seen on the way
+func (r *eventRecorder) waitFor(t *testing.T, typ rrd2prom.EventType) []rrd2prom.Event {
+	t.Helper()
+
+	var seen []rrd2prom.Event
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case e := <-r.events:
+			seen = append(seen, e)
+			if e.Type == typ {
+				return seen
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for a %s event", typ)
+		}
+	}
+}
+
+// countType counts the events of type typ
+func countType(events []rrd2prom.Event, typ rrd2prom.EventType) int {
+	n := 0
+	for _, e := range events {
+		if e.Type == typ {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRRDManager_CircuitBreaker(t *testing.T) {
+	fakes := newFakeRRDs(t)
+	file := newFastFile(t, fakes, "port1")
+	events := newEventRecorder()
+
+	m, sink := newManager(t, []*rrd2prom.RRDFile{file},
+		events.option(),
+		rrd2prom.WithCircuitBreaker(2, 0),
+		rrd2prom.WithBackoff(20*time.Millisecond),
+	)
+	startManager(t, m, sink)
+	waitForMetric(t, sink, "port1")
+
+	// break the source: one failure is reported, then the circuit opens
+	// and it goes quiet
+	fakes.mu.Lock()
+	delete(fakes.infos, "port1.rrd")
+	fakes.mu.Unlock()
+
+	seen := events.waitFor(t, rrd2prom.EventCircuitOpened)
+	assert.Equal(t, 1, countType(seen, rrd2prom.EventUpdateFailed))
+
+	statuses := m.SourceStatuses()
+	require.Len(t, statuses, 1)
+	assert.NotEqual(t, rrd2prom.CircuitClosed, statuses[0].State)
+	assert.GreaterOrEqual(t, statuses[0].Failures, 2)
+	assert.Error(t, statuses[0].LastError)
+
+	var buf bytes.Buffer
+	require.NoError(t, m.WriteSelfMetrics(&buf))
+	self := buf.String()
+	assert.Contains(t, self, `rrd2prom_source_circuit_state{file="port1"}`)
+	assert.Contains(t, self, `rrd2prom_update_errors_total{kind="not_found"}`)
+	assert.Contains(t, self, `rrd2prom_update_duration_seconds_bucket{file="port1",le="+Inf"}`)
+	assert.Contains(t, self, `rrd2prom_last_success_timestamp_seconds{file="port1"}`)
+	assert.Contains(t, self, `rrd2prom_handlers 1`)
+	assert.Contains(t, self, `rrd2prom_build_info{version="dev"`)
+
+	// once it comes back the circuit closes again
+	fakes.set("port1.rrd", 1735589344, 42)
+	seen = events.waitFor(t, rrd2prom.EventCircuitClosed)
+	assert.Zero(t, countType(seen, rrd2prom.EventUpdateFailed))
+
+	statuses = m.SourceStatuses()
+	assert.Equal(t, rrd2prom.CircuitClosed, statuses[0].State)
+	assert.Zero(t, statuses[0].Failures)
+}
+
+func TestRRDManager_GiveUp(t *testing.T) {
+	fakes := newFakeRRDs(t)
+	file := newFastFile(t, fakes, "port1")
+	events := newEventRecorder()
+
+	m, sink := newManager(t, []*rrd2prom.RRDFile{file},
+		events.option(),
+		rrd2prom.WithCircuitBreaker(1, 3),
+		rrd2prom.WithBackoff(20*time.Millisecond),
+	)
+	startManager(t, m, sink)
+	waitForMetric(t, sink, "port1")
+
+	fakes.mu.Lock()
+	delete(fakes.infos, "port1.rrd")
+	fakes.mu.Unlock()
+
+	dropped := events.waitFor(t, rrd2prom.EventSourceDropped)
+	assert.Equal(t, "port1", dropped[len(dropped)-1].File)
+	assert.Empty(t, m.Files())
+
+	// removing it again is an error since it's already gone
+	assert.Error(t, m.Remove("port1"))
+}
@@ -0,0 +1,236 @@
+package rrd2prom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultInfluxMeasurement is the default template for Influx measurement
+// names
+const DefaultInfluxMeasurement = "{{.Name}}"
+
+// InfluxOptions configures an InfluxSink. URL and Bucket are required.
+type InfluxOptions struct {
+	// URL is the InfluxDB server's base URL, like http://influx:8086
+	URL string
+	// Org, Bucket and Token say where to write and as who
+	Org    string
+	Bucket string
+	Token  string
+	// Measurement is a path template for measurement names, see
+	// NewPathTemplate. Defaults to DefaultInfluxMeasurement
+	Measurement string
+	// Buffer is how many lines are kept while InfluxDB can't be reached,
+	// defaults to 100000
+	Buffer int
+	// Timeout bounds each write, defaults to 10s. It's ignored when Client
+	// is set
+	Timeout time.Duration
+	Client  *http.Client
+}
+
+// InfluxSink is a Sink that writes metrics to InfluxDB 2's /api/v2/write
+// in line protocol. Each metric is a point in the measurement its
+// template names, with its labels, file included, as tags, its value as
+// the value field, and the file's last update as its timestamp, to the
+// second. Unknown values are left out since Influx can't store them.
+//
+// Lines that couldn't be written because InfluxDB couldn't be reached or
+// was too busy are kept and sent along with the next batch, up to Buffer
+// of them, after which the oldest are dropped. Lines InfluxDB rejected
+// are dropped right away. Close has a last go at sending the lines still
+// buffered.
+type InfluxSink struct {
+	opts        InfluxOptions
+	client      *http.Client
+	writeURL    string
+	measurement *PathTemplate
+
+	// mu guards buf and keeps writes in order
+	mu  sync.Mutex
+	buf lineBuffer
+}
+
+// NewInfluxSink creates an InfluxSink, checking its options.
+func NewInfluxSink(opts InfluxOptions) (*InfluxSink, error) {
+	base, err := url.Parse(opts.URL)
+	if err != nil || base.Scheme == "" || base.Host == "" {
+		return nil, fmt.Errorf("invalid Influx URL %q", opts.URL)
+	}
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("no Influx bucket")
+	}
+	if opts.Measurement == "" {
+		opts.Measurement = DefaultInfluxMeasurement
+	}
+	measurement, err := NewPathTemplate(opts.Measurement)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Buffer <= 0 {
+		opts.Buffer = defaultLineBuffer
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	client := opts.Client
+	if client == nil {
+		client = &http.Client{Timeout: opts.Timeout}
+	}
+
+	query := url.Values{"bucket": {opts.Bucket}, "precision": {"s"}}
+	if opts.Org != "" {
+		query.Set("org", opts.Org)
+	}
+	writeURL := strings.TrimSuffix(base.String(), "/") + "/api/v2/write?" + query.Encode()
+
+	return &InfluxSink{
+		opts:        opts,
+		client:      client,
+		writeURL:    writeURL,
+		measurement: measurement,
+		buf:         lineBuffer{size: opts.Buffer},
+	}, nil
+}
+
+// WriteMetrics implements Sink.
+func (s *InfluxSink) WriteMetrics(file string, metrics []Metric) error {
+	var errs []error
+	lines := make([]string, 0, len(metrics))
+	for _, metric := range metrics {
+		line, err := s.line(metric)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.buf.add(lines)
+	errs = append(errs, s.buf.droppedErr("influx"))
+	errs = append(errs, s.flush(context.Background()))
+
+	return errors.Join(errs...)
+}
+
+// Close implements io.Closer by trying once more, for up to Timeout, to
+// send the lines still buffered. Lines that still can't be sent are kept
+// for the next write, the sink can be written to afterwards.
+func (s *InfluxSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.Timeout)
+	defer cancel()
+
+	return s.flush(ctx)
+}
+
+// flush sends the buffered lines, keeping them if they should be tried
+// again. s.mu must be held by the caller.
+func (s *InfluxSink) flush(ctx context.Context) error {
+	if len(s.buf.lines) == 0 {
+		return nil
+	}
+	keep, err := s.write(ctx, strings.Join(s.buf.lines, ""))
+	if keep {
+		return fmt.Errorf("%w, %d lines buffered", err, len(s.buf.lines))
+	}
+	s.buf.lines = nil
+
+	return err
+}
+
+// write sends lines to InfluxDB, reporting whether they should be kept
+// to try again if that failed
+func (s *InfluxSink) write(ctx context.Context, lines string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.writeURL, strings.NewReader(lines))
+	if err != nil {
+		return false, fmt.Errorf("couldn't write to influx: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.opts.Token != "" {
+		req.Header.Set("Authorization", "Token "+s.opts.Token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("couldn't write to influx: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		err := fmt.Errorf("couldn't write to influx: bad status: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		// sending the same lines again won't get them accepted
+		keep := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return keep, err
+	}
+
+	return false, nil
+}
+
+// line formats metric in line protocol, or returns "" for unknown values
+func (s *InfluxSink) line(metric Metric) (string, error) {
+	if math.IsNaN(metric.Value) || math.IsInf(metric.Value, 0) {
+		return "", nil
+	}
+
+	measurement, err := s.measurement.execute(metric, nil)
+	if err != nil {
+		return "", err
+	}
+
+	at := metric.LastUpdate
+	if at.IsZero() {
+		at = metric.Timestamp
+	}
+
+	pairs := metric.labelPairs()
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+
+	var b strings.Builder
+	b.WriteString(influxEscape(measurement, ", "))
+	for _, pair := range pairs {
+		if pair[1] == "" {
+			continue
+		}
+		b.WriteString("," + influxEscape(pair[0], ",= ") + "=" + influxEscape(pair[1], ",= "))
+	}
+	b.WriteString(" value=" + strconv.FormatFloat(metric.Value, 'g', -1, 64))
+	b.WriteString(" " + strconv.FormatInt(at.Unix(), 10) + "\n")
+
+	return b.String(), nil
+}
+
+// influxEscape backslash escapes the characters in special. Line protocol
+// can't hold newlines at all, so they become spaces.
+func influxEscape(s, special string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r == '\n' || r == '\r' {
+			r = ' '
+		}
+		if strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
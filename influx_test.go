@@ -0,0 +1,155 @@
+package rrd2prom_test
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jessegalley/rrd2prom"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// influxServer is a stand-in InfluxDB that records every write
+type influxServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	status int
+	query  string
+	auth   string
+	bodies []string
+}
+
+func newInfluxServer(t *testing.T) *influxServer {
+	t.Helper()
+
+	s := &influxServer{status: http.StatusNoContent}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.query, s.auth = r.URL.Path+"?"+r.URL.RawQuery, r.Header.Get("Authorization")
+		if s.status/100 == 2 {
+			s.bodies = append(s.bodies, string(body))
+		}
+		w.WriteHeader(s.status)
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func TestInfluxSink(t *testing.T) {
+	server := newInfluxServer(t)
+
+	sink, err := rrd2prom.NewInfluxSink(rrd2prom.InfluxOptions{
+		URL:         server.URL + "/",
+		Org:         "ops",
+		Bucket:      "rrd",
+		Token:       "secret",
+		Measurement: "{{.File}}",
+	})
+	require.NoError(t, err)
+
+	updated := time.Unix(1735589344, 0)
+	require.NoError(t, sink.WriteMetrics("eth1 24", []rrd2prom.Metric{
+		{Name: "rrd_traffic_in", File: "eth1 24", Source: "traffic_in", Value: 42, Labels: map[string]string{"site": "a,b=c", "empty": ""}, LastUpdate: updated},
+		{Name: "rrd_temp", File: "eth1 24", Source: "temp", Value: math.NaN(), LastUpdate: updated},
+	}))
+
+	server.mu.Lock()
+	assert.Equal(t, "/api/v2/write?bucket=rrd&org=ops&precision=s", server.query)
+	assert.Equal(t, "Token secret", server.auth)
+	assert.Equal(t, []string{`eth1\ 24,file=eth1\ 24,site=a\,b\=c value=42 1735589344` + "\n"}, server.bodies)
+	server.mu.Unlock()
+
+	for _, bad := range []rrd2prom.InfluxOptions{
+		{URL: "influx:8086", Bucket: "rrd"},
+		{URL: server.URL},
+		{URL: server.URL, Bucket: "rrd", Measurement: "{{.Nope}}"},
+	} {
+		_, err := rrd2prom.NewInfluxSink(bad)
+		assert.Error(t, err)
+	}
+}
+
+func TestInfluxSink_Buffering(t *testing.T) {
+	server := newInfluxServer(t)
+
+	sink, err := rrd2prom.NewInfluxSink(rrd2prom.InfluxOptions{URL: server.URL, Bucket: "rrd", Buffer: 2})
+	require.NoError(t, err)
+	write := func(at int64) error {
+		return sink.WriteMetrics("port1", []rrd2prom.Metric{
+			{Name: "rrd_traffic_in", File: "port1", Value: 1, LastUpdate: time.Unix(at, 0)},
+		})
+	}
+
+	// lines are held on to while InfluxDB is unavailable, the oldest
+	// making way once the buffer is full
+	server.mu.Lock()
+	server.status = http.StatusServiceUnavailable
+	server.mu.Unlock()
+	assert.Error(t, write(60))
+	assert.Error(t, write(120))
+
+	server.mu.Lock()
+	server.status = http.StatusNoContent
+	server.mu.Unlock()
+	err = write(180)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "dropped 1 lines")
+	require.NoError(t, write(240))
+
+	server.mu.Lock()
+	assert.Equal(t, []string{
+		"rrd_traffic_in,file=port1 value=1 120\nrrd_traffic_in,file=port1 value=1 180\n",
+		"rrd_traffic_in,file=port1 value=1 240\n",
+	}, server.bodies)
+	server.bodies = nil
+	// lines InfluxDB rejects aren't tried again
+	server.status = http.StatusBadRequest
+	server.mu.Unlock()
+	assert.Error(t, write(300))
+
+	server.mu.Lock()
+	server.status = http.StatusNoContent
+	server.mu.Unlock()
+	require.NoError(t, write(360))
+
+	server.mu.Lock()
+	assert.Equal(t, []string{"rrd_traffic_in,file=port1 value=1 360\n"}, server.bodies)
+	server.mu.Unlock()
+}
+
+func TestInfluxSink_Close(t *testing.T) {
+	server := newInfluxServer(t)
+
+	sink, err := rrd2prom.NewInfluxSink(rrd2prom.InfluxOptions{URL: server.URL, Bucket: "rrd"})
+	require.NoError(t, err)
+
+	server.mu.Lock()
+	server.status = http.StatusServiceUnavailable
+	server.mu.Unlock()
+	require.Error(t, sink.WriteMetrics("port1", []rrd2prom.Metric{
+		{Name: "rrd_traffic_in", File: "port1", Value: 1, LastUpdate: time.Unix(60, 0)},
+	}))
+
+	// lines still buffered are kept if InfluxDB is still down, and sent if
+	// it's back
+	assert.Error(t, sink.Close())
+
+	server.mu.Lock()
+	server.status = http.StatusNoContent
+	server.mu.Unlock()
+	require.NoError(t, sink.Close())
+
+	server.mu.Lock()
+	assert.Equal(t, []string{"rrd_traffic_in,file=port1 value=1 60\n"}, server.bodies)
+	server.mu.Unlock()
+}
@@ -0,0 +1,96 @@
+package rrd2prom
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// WithInfoMetrics has the manager export the layout of every file as
+// info metrics with a value of 1, next to its data sources:
+//
+//	<prefix>_info{version, step}
+//	<prefix>_ds_info{ds, type, index, min, max, heartbeat}
+//	<prefix>_rra_info{rra, cf, pdp_per_row, rows, xff}
+//
+// where prefix is the Namer's prefix. Durations are in seconds, and xff
+// is left out for the Holt-Winters RRAs that don't have one. They carry
+// the file's labels, but aren't relabeled.
+func WithInfoMetrics() Option {
+	return func(m *RRDManager) {
+		m.infoMetrics = true
+	}
+}
+
+// layoutMetrics returns the info metrics describing snap, see
+// WithInfoMetrics
+func (m *RRDManager) layoutMetrics(snap RRDSnapshot, now time.Time) []Metric {
+	metrics := make([]Metric, 0, 1+len(snap.DataSources)+len(snap.RRAs))
+	info := func(name, source string, labels map[string]string) {
+		merged := make(map[string]string, len(snap.Labels)+len(labels))
+		for k, v := range snap.Labels {
+			merged[k] = v
+		}
+		for k, v := range labels {
+			if v != "" {
+				merged[k] = v
+			}
+		}
+		metrics = append(metrics, Metric{
+			Name:       m.namer.clean(m.namer.prefix + "_" + name),
+			File:       snap.Name,
+			Value:      1,
+			Source:     source,
+			Type:       "GAUGE",
+			Labels:     merged,
+			FileLabels: snap.Labels,
+			Timestamp:  now,
+			LastUpdate: snap.LastUpdate,
+		})
+	}
+
+	info("info", "", map[string]string{
+		"version": snap.Version,
+		"step":    formatSeconds(snap.Step),
+	})
+
+	names := make([]string, 0, len(snap.DataSources))
+	for name := range snap.DataSources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ds := snap.DataSources[name]
+		info("ds_info", name, map[string]string{
+			"ds":        name,
+			"type":      ds.Type,
+			"index":     strconv.FormatUint(uint64(ds.Index), 10),
+			"min":       formatFloat(ds.Min),
+			"max":       formatFloat(ds.Max),
+			"heartbeat": formatSeconds(ds.Heartbeat),
+		})
+	}
+
+	for i, rra := range snap.RRAs {
+		xff := ""
+		if !math.IsNaN(rra.XFF) {
+			xff = formatFloat(rra.XFF)
+		}
+		info("rra_info", "", map[string]string{
+			"rra":         strconv.Itoa(i),
+			"cf":          rra.CF,
+			"pdp_per_row": strconv.FormatUint(uint64(rra.PDPPerRow), 10),
+			"rows":        strconv.FormatUint(uint64(rra.Rows), 10),
+			"xff":         xff,
+		})
+	}
+
+	return metrics
+}
+
+// formatSeconds formats d as a whole number of seconds
+func formatSeconds(d time.Duration) string {
+	return fmt.Sprint(int64(d / time.Second))
+}
@@ -0,0 +1,101 @@
+package rrd2prom_test
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/jessegalley/rrd2prom"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setLayout adds the version, heartbeat, range and RRA keys librrd
+// reports to a fake RRD
+func setLayout(fakes *fakeRRDs, location string) {
+	fakes.mu.Lock()
+	defer fakes.mu.Unlock()
+
+	info := fakes.infos[location]
+	info["rrd_version"] = "0003"
+	info["ds.minimal_heartbeat"] = map[string]interface{}{"traffic_in": uint(120)}
+	info["ds.min"] = map[string]interface{}{"traffic_in": 0.0}
+	info["ds.max"] = map[string]interface{}{"traffic_in": math.NaN()}
+	info["rra.cf"] = []interface{}{"AVERAGE", "MAX"}
+	info["rra.rows"] = []interface{}{uint(1440), uint(797)}
+	info["rra.pdp_per_row"] = []interface{}{uint(1), uint(6)}
+	info["rra.xff"] = []interface{}{0.5, 0.5}
+}
+
+func TestRRDFile_Layout(t *testing.T) {
+	fakes := newFakeRRDs(t)
+	fakes.set("port1.rrd", 1735589344, 1)
+	setLayout(fakes, "port1.rrd")
+
+	file, err := rrd2prom.NewRRDFile("port1.rrd", "port1")
+	require.NoError(t, err)
+
+	snap := file.Snapshot()
+	assert.Equal(t, "0003", snap.Version)
+	assert.Equal(t, 2*time.Minute, snap.DataSources["traffic_in"].Heartbeat)
+	assert.Equal(t, []rrd2prom.RRA{
+		{CF: "AVERAGE", PDPPerRow: 1, Rows: 1440, XFF: 0.5},
+		{CF: "MAX", PDPPerRow: 6, Rows: 797, XFF: 0.5},
+	}, snap.RRAs)
+
+	// Holt-Winters RRAs have no xff, which librrd leaves out
+	fakes.mu.Lock()
+	info := fakes.infos["port1.rrd"]
+	info["rra.cf"] = []interface{}{"AVERAGE", "HWPREDICT", "SEASONAL", "DEVSEASONAL", "DEVPREDICT", "FAILURES"}
+	info["rra.rows"] = []interface{}{uint(1440), uint(1440), uint(288), uint(288), uint(1440), uint(1440)}
+	info["rra.pdp_per_row"] = []interface{}{uint(1), uint(1), uint(1), uint(1), uint(1), uint(1)}
+	info["rra.xff"] = []interface{}{0.5, nil}
+	fakes.mu.Unlock()
+	require.NoError(t, file.Update())
+
+	snap = file.Snapshot()
+	require.Len(t, snap.RRAs, 6)
+	assert.Equal(t, 0.5, snap.RRAs[0].XFF)
+	for _, rra := range snap.RRAs[1:] {
+		assert.True(t, math.IsNaN(rra.XFF), rra.CF)
+	}
+	assert.Equal(t, "FAILURES", snap.RRAs[5].CF)
+
+	// an RRA missing one of its settings only loses the layout, the data
+	// sources are still read
+	fakes.mu.Lock()
+	info["rra.rows"] = []interface{}{uint(1440)}
+	info["ds.last_ds"] = map[string]interface{}{"traffic_in": "43"}
+	fakes.mu.Unlock()
+	require.NoError(t, file.Update())
+	snap = file.Snapshot()
+	assert.Empty(t, snap.RRAs)
+	assert.Equal(t, 43.0, snap.DataSources["traffic_in"].LastValue)
+}
+
+func TestRRDManager_InfoMetrics(t *testing.T) {
+	fakes := newFakeRRDs(t)
+	store := rrd2prom.NewStore()
+
+	file := newFastFile(t, fakes, "port1")
+	setLayout(fakes, "port1.rrd")
+	file.Labels = map[string]string{"site": "ams"}
+
+	m, sink := newManager(t, []*rrd2prom.RRDFile{file},
+		rrd2prom.WithInfoMetrics(),
+		rrd2prom.WithSink(store, rrd2prom.SinkOptions{Name: "store"}),
+	)
+	startManager(t, m, sink)
+
+	assert.Eventually(t, func() bool { return len(store.Metrics()) == 5 }, 2*time.Second, 5*time.Millisecond)
+
+	var buf bytes.Buffer
+	require.NoError(t, store.WriteText(&buf))
+	assert.Equal(t, `rrd_ds_info{ds="traffic_in",file="port1",heartbeat="120",index="0",max="NaN",min="0",site="ams",type="COUNTER"} 1
+rrd_info{file="port1",site="ams",step="60",version="0003"} 1
+rrd_rra_info{cf="AVERAGE",file="port1",pdp_per_row="1",rows="1440",rra="0",site="ams",xff="0.5"} 1
+rrd_rra_info{cf="MAX",file="port1",pdp_per_row="6",rows="797",rra="1",site="ams",xff="0.5"} 1
+rrd_traffic_in{file="port1",site="ams"} 42
+`, buf.String())
+}
@@ -0,0 +1,299 @@
+package rrd2prom
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version is the version of rrd2prom reported by the build info metric,
+// set at build time with -ldflags "-X github.com/jessegalley/rrd2prom.Version=...".
+var Version = "dev"
+
+// durationBuckets are the upper bounds of the update duration histogram,
+// in seconds
+var durationBuckets = [...]float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram is a minimal cumulative histogram using durationBuckets.
+// it's guarded by whatever owns it.
+type histogram struct {
+	counts [len(durationBuckets)]uint64
+	count  uint64
+	sum    float64
+}
+
+// observe records a single value
+func (h *histogram) observe(v float64) {
+	for i, bound := range durationBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// sourceCounters is the instrumentation of a single source. It's kept by
+// the manager rather than the source's RRDFile or handler, so that
+// restarting the source on a config change carries on counting.
+type sourceCounters struct {
+	durations    histogram
+	bytesFetched uint64
+
+	// file is the RRDFile bytesFetched has caught up with, as of when it
+	// had fetched fileBytes
+	file      *RRDFile
+	fileBytes uint64
+}
+
+// sourceCounterSet holds the counters of every source, by name
+type sourceCounterSet struct {
+	mu     sync.Mutex
+	byName map[string]*sourceCounters
+}
+
+// observe records a read of file that took took, and catches up with
+// what it has downloaded since the last one
+func (c *sourceCounterSet) observe(file *RRDFile, took time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.byName == nil {
+		c.byName = make(map[string]*sourceCounters)
+	}
+	counters := c.byName[file.Name]
+	if counters == nil {
+		counters = &sourceCounters{}
+		c.byName[file.Name] = counters
+	}
+
+	counters.durations.observe(took.Seconds())
+	if counters.file != file {
+		counters.file, counters.fileBytes = file, 0
+	}
+	fetched := file.BytesFetched()
+	counters.bytesFetched += fetched - counters.fileBytes
+	counters.fileBytes = fetched
+}
+
+// get returns a copy of the counters of the source called name
+func (c *sourceCounterSet) get(name string) (histogram, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counters := c.byName[name]
+	if counters == nil {
+		return histogram{}, 0
+	}
+	return counters.durations, counters.bytesFetched
+}
+
+// release forgets the counters of the source called name
+func (c *sourceCounterSet) release(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.byName, name)
+}
+
+// errorCounts counts failed updates by error kind
+type errorCounts struct {
+	mu     sync.Mutex
+	byKind map[string]uint64
+}
+
+// add counts one error of kind
+func (c *errorCounts) add(kind string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.byKind == nil {
+		c.byKind = make(map[string]uint64)
+	}
+	c.byKind[kind]++
+}
+
+// snapshot returns a copy of the counts
+func (c *errorCounts) snapshot() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counts := make(map[string]uint64, len(c.byKind))
+	for kind, n := range c.byKind {
+		counts[kind] = n
+	}
+	return counts
+}
+
+// sourceInstruments is a copy of the per source instrumentation taken
+// for writing out
+type sourceInstruments struct {
+	name         string
+	http         bool
+	bytesFetched uint64
+	lastSuccess  time.Time
+	durations    histogram
+}
+
+// sourceInstruments gathers the instrumentation of every managed source,
+// sorted by name.
+func (m *RRDManager) sourceInstruments() []sourceInstruments {
+	m.mu.Lock()
+	handlers := make([]*handler, 0, len(m.handlers))
+	for _, h := range m.handlers {
+		handlers = append(handlers, h)
+	}
+	m.mu.Unlock()
+
+	sources := make([]sourceInstruments, 0, len(handlers))
+	for _, h := range handlers {
+		durations, bytesFetched := m.counters.get(h.file.Name)
+		h.health.mu.Lock()
+		sources = append(sources, sourceInstruments{
+			name:         h.file.Name,
+			http:         isURL(h.file.Location),
+			bytesFetched: bytesFetched,
+			lastSuccess:  h.health.lastSuccess,
+			durations:    durations,
+		})
+		h.health.mu.Unlock()
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].name < sources[j].name })
+
+	return sources
+}
+
+// WriteSelfMetrics writes metrics about the manager itself, as opposed to
+// the RRD files it collects, to w in the Prometheus text exposition
+// format.
+func (m *RRDManager) WriteSelfMetrics(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	writeHeader(bw, "rrd2prom_build_info", "gauge", "Build information about rrd2prom, always 1.")
+	revision := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				revision = setting.Value
+			}
+		}
+	}
+	fmt.Fprintf(bw, "rrd2prom_build_info{version=\"%s\",revision=\"%s\",goversion=\"%s\"} 1\n",
+		escapeLabelValue(Version), escapeLabelValue(revision), runtime.Version())
+
+	sources := m.sourceInstruments()
+
+	writeHeader(bw, "rrd2prom_handlers", "gauge", "RRD files currently managed.")
+	fmt.Fprintf(bw, "rrd2prom_handlers %d\n", len(sources))
+
+	writeHeader(bw, "rrd2prom_update_duration_seconds", "histogram", "Time taken to read each RRD file.")
+	for _, src := range sources {
+		file := escapeLabelValue(src.name)
+		for i, bound := range durationBuckets {
+			fmt.Fprintf(bw, "rrd2prom_update_duration_seconds_bucket{file=\"%s\",le=\"%s\"} %d\n",
+				file, formatFloat(bound), src.durations.counts[i])
+		}
+		fmt.Fprintf(bw, "rrd2prom_update_duration_seconds_bucket{file=\"%s\",le=\"+Inf\"} %d\n", file, src.durations.count)
+		fmt.Fprintf(bw, "rrd2prom_update_duration_seconds_sum{file=\"%s\"} %s\n", file, formatFloat(src.durations.sum))
+		fmt.Fprintf(bw, "rrd2prom_update_duration_seconds_count{file=\"%s\"} %d\n", file, src.durations.count)
+	}
+
+	writeHeader(bw, "rrd2prom_last_success_timestamp_seconds", "gauge", "Unix time of the last successful read of each RRD file.")
+	for _, src := range sources {
+		if src.lastSuccess.IsZero() {
+			continue
+		}
+		fmt.Fprintf(bw, "rrd2prom_last_success_timestamp_seconds{file=\"%s\"} %s\n",
+			escapeLabelValue(src.name), formatFloat(float64(src.lastSuccess.UnixMilli())/1000))
+	}
+
+	writeHeader(bw, "rrd2prom_http_fetched_bytes_total", "counter", "Bytes downloaded for each RRD file read over HTTP.")
+	for _, src := range sources {
+		if src.http {
+			fmt.Fprintf(bw, "rrd2prom_http_fetched_bytes_total{file=\"%s\"} %d\n", escapeLabelValue(src.name), src.bytesFetched)
+		}
+	}
+
+	writeHeader(bw, "rrd2prom_update_errors_total", "counter", "Failed RRD file reads by kind of error.")
+	errs := m.updateErrors.snapshot()
+	kinds := make([]string, 0, len(errs))
+	for kind := range errs {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(bw, "rrd2prom_update_errors_total{kind=\"%s\"} %d\n", escapeLabelValue(kind), errs[kind])
+	}
+
+	statuses := m.SourceStatuses()
+
+	writeHeader(bw, "rrd2prom_source_circuit_state", "gauge", "Circuit breaker state of each source: 0 closed, 1 open, 2 half open.")
+	for _, status := range statuses {
+		fmt.Fprintf(bw, "rrd2prom_source_circuit_state{file=\"%s\"} %d\n", escapeLabelValue(status.Name), status.State)
+	}
+
+	writeHeader(bw, "rrd2prom_source_consecutive_failures", "gauge", "Failed reads in a row of each source.")
+	for _, status := range statuses {
+		fmt.Fprintf(bw, "rrd2prom_source_consecutive_failures{file=\"%s\"} %d\n", escapeLabelValue(status.Name), status.Failures)
+	}
+
+	sinks := m.SinkStats()
+
+	writeHeader(bw, "rrd2prom_sink_queue_depth", "gauge", "Batches of metrics waiting to be written to each sink.")
+	for _, sink := range sinks {
+		fmt.Fprintf(bw, "rrd2prom_sink_queue_depth{sink=\"%s\"} %d\n", escapeLabelValue(sink.Name), sink.Queued)
+	}
+
+	writeHeader(bw, "rrd2prom_sink_metrics_total", "counter", "Metrics written to each sink.")
+	for _, sink := range sinks {
+		fmt.Fprintf(bw, "rrd2prom_sink_metrics_total{sink=\"%s\"} %d\n", escapeLabelValue(sink.Name), sink.Metrics)
+	}
+
+	writeHeader(bw, "rrd2prom_sink_dropped_metrics_total", "counter", "Metrics dropped because a sink's buffer was full.")
+	for _, sink := range sinks {
+		fmt.Fprintf(bw, "rrd2prom_sink_dropped_metrics_total{sink=\"%s\"} %d\n", escapeLabelValue(sink.Name), sink.Dropped)
+	}
+
+	writeHeader(bw, "rrd2prom_sink_errors_total", "counter", "Failed writes to each sink.")
+	for _, sink := range sinks {
+		fmt.Fprintf(bw, "rrd2prom_sink_errors_total{sink=\"%s\"} %d\n", escapeLabelValue(sink.Name), sink.Errors)
+	}
+
+	writeHeader(bw, "rrd2prom_dropped_events_total", "counter", "Events dropped because the event handlers couldn't keep up.")
+	fmt.Fprintf(bw, "rrd2prom_dropped_events_total %d\n", m.DroppedEvents())
+
+	sched := m.SchedulerStats()
+
+	writeHeader(bw, "rrd2prom_scheduler_workers", "gauge", "Size of the worker pool.")
+	fmt.Fprintf(bw, "rrd2prom_scheduler_workers %d\n", sched.Workers)
+	writeHeader(bw, "rrd2prom_scheduler_workers_busy", "gauge", "Workers reading an RRD file right now.")
+	fmt.Fprintf(bw, "rrd2prom_scheduler_workers_busy %d\n", sched.Busy)
+	writeHeader(bw, "rrd2prom_scheduler_queue_depth", "gauge", "RRD files that are due but waiting for a free worker.")
+	fmt.Fprintf(bw, "rrd2prom_scheduler_queue_depth %d\n", sched.QueueDepth)
+	writeHeader(bw, "rrd2prom_scheduler_runs_total", "counter", "Reads handed to the worker pool.")
+	fmt.Fprintf(bw, "rrd2prom_scheduler_runs_total %d\n", sched.Runs)
+	writeHeader(bw, "rrd2prom_scheduler_lateness_seconds_total", "counter", "Time RRD files spent waiting past their scheduled read, summed over all reads.")
+	fmt.Fprintf(bw, "rrd2prom_scheduler_lateness_seconds_total %s\n", formatFloat(sched.TotalLateness.Seconds()))
+	writeHeader(bw, "rrd2prom_scheduler_max_lateness_seconds", "gauge", "Longest an RRD file has waited past its scheduled read.")
+	fmt.Fprintf(bw, "rrd2prom_scheduler_max_lateness_seconds %s\n", formatFloat(sched.MaxLateness.Seconds()))
+
+	return bw.Flush()
+}
+
+// writeHeader writes the HELP and TYPE lines for a metric family
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.ReplaceAll(help, "\n", `\n`))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+// formatFloat formats v the way the exposition format expects
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
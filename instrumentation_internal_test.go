@@ -0,0 +1,34 @@
+package rrd2prom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSourceCounterSet(t *testing.T) {
+	var counters sourceCounterSet
+
+	old := &RRDFile{Name: "port1", Location: "http://nms/port1.rrd"}
+	old.bytesFetched.Add(100)
+	counters.observe(old, time.Millisecond)
+	old.bytesFetched.Add(50)
+	counters.observe(old, time.Millisecond)
+
+	// the source being restarted with a new RRDFile carries on counting
+	replaced := &RRDFile{Name: "port1", Location: "http://nms/port1.rrd"}
+	replaced.bytesFetched.Add(30)
+	counters.observe(replaced, time.Second)
+
+	durations, fetched := counters.get("port1")
+	assert.Equal(t, uint64(3), durations.count)
+	assert.InDelta(t, 1.002, durations.sum, 1e-9)
+	assert.Equal(t, uint64(180), fetched)
+
+	// until it's removed
+	counters.release("port1")
+	durations, fetched = counters.get("port1")
+	assert.Zero(t, durations.count)
+	assert.Zero(t, fetched)
+}
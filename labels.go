@@ -0,0 +1,71 @@
+package rrd2prom
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// reservedLabels are set by the manager itself and can't be set in config
+var reservedLabels = map[string]bool{"file": true}
+
+// labelNameRE matches a valid Prometheus label name
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// checkLabelName returns an error if name can't be used as a label
+func checkLabelName(name string) error {
+	if !labelNameRE.MatchString(name) {
+		return fmt.Errorf("invalid label name %q", name)
+	}
+	// Prometheus keeps names starting with __ for itself
+	if strings.HasPrefix(name, "__") {
+		return fmt.Errorf("label name %q is reserved for internal use", name)
+	}
+	if reservedLabels[name] {
+		return fmt.Errorf("label %s is reserved", name)
+	}
+
+	return nil
+}
+
+// compileLabelPattern compiles a pattern whose named capture groups
+// become labels, checking that every group name is a usable label name.
+func compileLabelPattern(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid label pattern %q: %w", pattern, err)
+	}
+
+	named := 0
+	for _, name := range re.SubexpNames()[1:] {
+		if name == "" {
+			continue
+		}
+		if err := checkLabelName(name); err != nil {
+			return nil, fmt.Errorf("invalid label pattern %q: %w", pattern, err)
+		}
+		named++
+	}
+	if named == 0 {
+		return nil, fmt.Errorf("invalid label pattern %q: no named capture groups", pattern)
+	}
+
+	return re, nil
+}
+
+// extractLabels matches location against each pattern in turn, adding a
+// label for every named group that captured something. Later patterns
+// win when they capture the same name.
+func extractLabels(patterns []*regexp.Regexp, location string, labels map[string]string) {
+	for _, re := range patterns {
+		match := re.FindStringSubmatch(location)
+		if match == nil {
+			continue
+		}
+		for i, name := range re.SubexpNames() {
+			if name != "" && match[i] != "" {
+				labels[name] = match[i]
+			}
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package rrd2prom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrRunning is returned by Start when the manager is already running.
+var ErrRunning = errors.New("manager is already running")
+
+// run is a single Start to shutdown cycle of the manager. every Start
+// gets a fresh one, so a manager can be started again once it stopped.
+type run struct {
+	stop     chan struct{} // closed to ask the run to stop
+	stopOnce sync.Once
+	finished chan struct{} // closed once everything has stopped
+
+	// errs collects why sources failed during the run, err is the
+	// joined result and only set once finished is closed
+	mu   sync.Mutex
+	errs []error
+	err  error
+}
+
+// requestStop asks the run to stop, it's safe to call any number of times
+func (r *run) requestStop() {
+	r.stopOnce.Do(func() { close(r.stop) })
+}
+
+// addErr records a failure to be reported by Wait
+func (r *run) addErr(err error) {
+	r.mu.Lock()
+	r.errs = append(r.errs, err)
+	r.mu.Unlock()
+}
+
+// Start starts the manager and a handler for every RRD file added so far
+// in the background, returning ErrRunning if it's already running. The
+// manager runs until Shutdown or Stop is called or ctx is done.
+//
+// A manager that has stopped can be started again. Sinks are reused
+// across runs, but ones that implement io.Closer will have been closed by
+// the previous shutdown.
+func (m *RRDManager) Start(ctx context.Context) error {
+	m.lifeMu.Lock()
+	defer m.lifeMu.Unlock()
+
+	if m.run != nil && !m.run.isFinished() {
+		return ErrRunning
+	}
+
+	r := &run{
+		stop:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	m.run = r
+
+	m.startEvents()
+	m.startSinks()
+	m.emit(Event{Type: EventManagerStarted})
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	m.sched.start(runCtx, &m.wg, m.runHandler)
+
+	// start a handler for each RRD file added so far, anything
+	// added from here on out is started by Add itself
+	m.mu.Lock()
+	m.ctx, m.cancel = runCtx, cancel
+	m.running = true
+	for _, h := range m.handlers {
+		m.startHandler(h)
+	}
+	m.mu.Unlock()
+
+	go func() {
+		select {
+		case <-r.stop:
+		case <-ctx.Done():
+		}
+		m.shutdown(r)
+	}()
+
+	return nil
+}
+
+// isFinished reports whether the run has completely stopped
+func (r *run) isFinished() bool {
+	select {
+	case <-r.finished:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown stops everything started by Start and finishes r.
+func (m *RRDManager) shutdown(r *run) {
+	// stop accepting new handlers, then cancel context for all handlers
+	m.mu.Lock()
+	m.running = false
+	m.cancel()
+	m.mu.Unlock()
+	m.ready.Store(false)
+
+	// wait for the scheduler and any running updates to complete, then
+	// for the sinks to flush
+	m.wg.Wait()
+	m.sched.reset()
+
+	m.mu.Lock()
+	for _, h := range m.handlers {
+		m.emit(Event{Type: EventHandlerStopped, File: h.file.Name, Location: h.file.Location})
+	}
+	m.mu.Unlock()
+
+	// sources that were still failing when we stopped are worth reporting
+	for _, status := range m.SourceStatuses() {
+		if status.State != CircuitClosed && status.LastError != nil {
+			r.addErr(fmt.Errorf("source %s: %w", status.Name, status.LastError))
+		}
+	}
+	for _, err := range m.closeSinks() {
+		r.addErr(err)
+	}
+
+	// send the final event, then let the dispatcher drain what's queued
+	m.emit(Event{Type: EventManagerStopped})
+	m.closeEvents()
+
+	r.mu.Lock()
+	r.err = errors.Join(r.errs...)
+	r.mu.Unlock()
+	close(r.finished)
+}
+
+// Shutdown stops the manager and waits for it to finish, or for ctx to be
+// done, whichever comes first. Handlers are cancelled straight away, so it
+// normally only has to wait for the sinks to drain. It's safe to call
+// more than once, and on a manager that isn't running.
+func (m *RRDManager) Shutdown(ctx context.Context) error {
+	m.lifeMu.Lock()
+	r := m.run
+	m.lifeMu.Unlock()
+
+	if r == nil {
+		return nil
+	}
+	r.requestStop()
+
+	select {
+	case <-r.finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Wait blocks until the current run of the manager has stopped and
+// returns why sources failed during it: the ones that were given up on
+// and the ones still failing when it stopped, along with any sink that
+// failed to close. It returns nil straight away if the manager was never
+// started.
+func (m *RRDManager) Wait() error {
+	m.lifeMu.Lock()
+	r := m.run
+	m.lifeMu.Unlock()
+
+	if r == nil {
+		return nil
+	}
+	<-r.finished
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Ready reports whether the manager is running and every file it manages
+// has been read at least once, successfully or not. Once ready, it stays
+// ready until the manager stops, even as files come and go.
+func (m *RRDManager) Ready() bool {
+	if m.ready.Load() {
+		return true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.running {
+		return false
+	}
+	for _, h := range m.handlers {
+		h.health.mu.Lock()
+		read := h.health.read
+		h.health.mu.Unlock()
+		if !read {
+			return false
+		}
+	}
+	m.ready.Store(true)
+
+	return true
+}
+
+// Run starts the manager and blocks until it stops, returning the same
+// error as Wait.
+func (m *RRDManager) Run() error {
+	if err := m.Start(context.Background()); err != nil {
+		return err
+	}
+
+	return m.Wait()
+}
+
+// CollectOnce reads every managed file a single time and delivers the
+// metrics to the sinks, for runs that exit straight after rather than
+// staying up. Files are read on the same number of workers as a running
+// manager uses, and sinks are flushed and closed before it returns, like
+// they are on shutdown. The error says which files couldn't be read, and
+// which sinks failed to close. It returns ErrRunning if the manager has
+// been started.
+func (m *RRDManager) CollectOnce(ctx context.Context) error {
+	m.lifeMu.Lock()
+	defer m.lifeMu.Unlock()
+
+	if m.run != nil && !m.run.isFinished() {
+		return ErrRunning
+	}
+
+	m.startEvents()
+	m.startSinks()
+
+	var (
+		mu   sync.Mutex
+		errs []error
+		wg   sync.WaitGroup
+	)
+	workers := make(chan struct{}, m.sched.workers)
+	for _, file := range m.Files() {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(file *RRDFile) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+
+			event := Event{Type: EventUpdateOK, File: file.Name, Location: file.Location}
+			event.Duration, event.Err = m.collect(ctx, file)
+			if event.Err != nil {
+				event.Type = EventUpdateFailed
+				m.updateErrors.add(errorKind(event.Err))
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("source %s: %w", file.Name, event.Err))
+				mu.Unlock()
+			}
+			m.emit(event)
+		}(file)
+	}
+	wg.Wait()
+
+	errs = append(errs, m.closeSinks()...)
+	m.closeEvents()
+
+	return errors.Join(errs...)
+}
+
+// Stop signals the manager to stop all handlers and clean up, without
+// waiting for it to finish. It's safe to call more than once.
+func (m *RRDManager) Stop() {
+	m.lifeMu.Lock()
+	defer m.lifeMu.Unlock()
+
+	if m.run != nil {
+		m.run.requestStop()
+	}
+}
+
+// recordRunErr adds err to the errors reported by Wait for the current run
+func (m *RRDManager) recordRunErr(err error) {
+	m.lifeMu.Lock()
+	r := m.run
+	m.lifeMu.Unlock()
+
+	if r != nil {
+		r.addErr(err)
+	}
+}
@@ -0,0 +1,94 @@
+package rrd2prom_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jessegalley/rrd2prom"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRRDManager_Lifecycle(t *testing.T) {
+	fakes := newFakeRRDs(t)
+	store := rrd2prom.NewStore()
+
+	m, err := rrd2prom.NewRRDManager([]*rrd2prom.RRDFile{newFastFile(t, fakes, "port1")},
+		rrd2prom.WithSink(store, rrd2prom.SinkOptions{Name: "store"}),
+	)
+	require.NoError(t, err)
+
+	// nothing to stop or wait for yet
+	assert.NoError(t, m.Shutdown(context.Background()))
+	assert.NoError(t, m.Wait())
+	assert.False(t, m.Ready())
+
+	require.NoError(t, m.Start(context.Background()))
+	assert.ErrorIs(t, m.Start(context.Background()), rrd2prom.ErrRunning)
+	assert.Eventually(t, m.Ready, 2*time.Second, 5*time.Millisecond)
+
+	// stopping more than once is fine
+	m.Stop()
+	require.NoError(t, m.Shutdown(context.Background()))
+	require.NoError(t, m.Shutdown(context.Background()))
+	m.Stop()
+	assert.NoError(t, m.Wait())
+	assert.False(t, m.Ready())
+
+	// and the manager can be started again
+	require.NoError(t, store.WriteMetrics("port1", nil))
+	require.NoError(t, m.Start(context.Background()))
+	assert.Eventually(t, func() bool { return len(store.Metrics()) == 1 }, 2*time.Second, 5*time.Millisecond)
+	require.NoError(t, m.Shutdown(context.Background()))
+}
+
+func TestRRDManager_StartContext(t *testing.T) {
+	fakes := newFakeRRDs(t)
+
+	m, sink := newManager(t, []*rrd2prom.RRDFile{newFastFile(t, fakes, "port1")})
+	go func() {
+		for range sink.C {
+		}
+	}()
+
+	// cancelling the context given to Start stops the manager
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(t, m.Start(ctx))
+	cancel()
+
+	done := make(chan error)
+	go func() { done <- m.Wait() }()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("manager didn't stop when its context was cancelled")
+	}
+}
+
+func TestRRDManager_WaitError(t *testing.T) {
+	fakes := newFakeRRDs(t)
+	events := newEventRecorder()
+
+	m, sink := newManager(t,
+		[]*rrd2prom.RRDFile{newFastFile(t, fakes, "port1"), newFastFile(t, fakes, "port2")},
+		events.option(),
+		rrd2prom.WithCircuitBreaker(1, 2),
+		rrd2prom.WithBackoff(10*time.Millisecond),
+	)
+	startManager(t, m, sink)
+
+	// port1 keeps failing until it's dropped
+	fakes.mu.Lock()
+	delete(fakes.infos, "port1.rrd")
+	fakes.mu.Unlock()
+	events.waitFor(t, rrd2prom.EventSourceDropped)
+
+	m.Stop()
+	err := m.Wait()
+	require.Error(t, err)
+	assert.ErrorIs(t, err, rrd2prom.ErrNotFound)
+	assert.Contains(t, err.Error(), "source port1 dropped")
+	assert.NotContains(t, err.Error(), "port2")
+}
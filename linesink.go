@@ -0,0 +1,114 @@
+package rrd2prom
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// PathTemplate builds the name a metric is written under by sinks that
+// don't have labels, or keep them apart from the name, like Graphite's
+// paths and Influx's measurements.
+type PathTemplate struct {
+	tmpl *template.Template
+}
+
+// pathData is what path templates are executed against
+type pathData struct {
+	Name   string
+	File   string
+	DS     string
+	Type   string
+	Labels map[string]string
+	// LabelValues are the values of the labels the metric doesn't share
+	// with its file, in label name order
+	LabelValues []string
+}
+
+// NewPathTemplate parses a text/template for metric paths. It can use
+// .Name (the metric's name), .File (the RRD file's name), .DS (the data
+// source's name, shared by a value and its rate), .Type (the data
+// source's type), .Labels (the metric's labels, file included, a label
+// the metric doesn't have being empty) and .LabelValues (the values of
+// the labels that set the metric apart from others of the same file,
+// like those added by relabeling, sorted by label name).
+func NewPathTemplate(text string) (*PathTemplate, error) {
+	tmpl, err := template.New("path").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path template: %w", err)
+	}
+
+	p := &PathTemplate{tmpl: tmpl}
+	// try it out so mistakes like unknown fields show up now rather than
+	// on the first write
+	if _, err := p.execute(Metric{Name: "name", File: "file", Source: "ds", Type: "GAUGE"}, nil); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// execute builds the path of metric, passing every value through clean
+// first if it's set
+func (p *PathTemplate) execute(metric Metric, clean func(string) string) (string, error) {
+	if clean == nil {
+		clean = func(s string) string { return s }
+	}
+
+	data := pathData{
+		Name:   clean(metric.Name),
+		File:   clean(metric.File),
+		DS:     clean(metric.Source),
+		Type:   clean(metric.Type),
+		Labels: make(map[string]string, len(metric.Labels)+1),
+	}
+	for _, pair := range metric.labelPairs() {
+		data.Labels[pair[0]] = clean(pair[1])
+	}
+	for _, pair := range pointLabels(metric, resourceLabels(metric.File, metric.FileLabels)) {
+		data.LabelValues = append(data.LabelValues, clean(pair[1]))
+	}
+
+	var b strings.Builder
+	if err := p.tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("invalid path template: %w", err)
+	}
+	if b.Len() == 0 {
+		return "", fmt.Errorf("empty path for %s of %s", metric.Source, metric.File)
+	}
+
+	return b.String(), nil
+}
+
+// defaultLineBuffer is how many lines a line sink holds on to while its
+// destination is unreachable
+const defaultLineBuffer = 100000
+
+// lineBuffer holds lines that couldn't be written yet, dropping the
+// oldest ones once it's full
+type lineBuffer struct {
+	lines   []string
+	size    int
+	dropped uint64
+}
+
+// add queues lines, making room for them if needed
+func (b *lineBuffer) add(lines []string) {
+	b.lines = append(b.lines, lines...)
+	if over := len(b.lines) - b.size; over > 0 {
+		b.dropped += uint64(over)
+		b.lines = append(b.lines[:0], b.lines[over:]...)
+	}
+}
+
+// droppedErr reports the lines that were lost to the buffer being full
+// since it was last called
+func (b *lineBuffer) droppedErr(sink string) error {
+	if b.dropped == 0 {
+		return nil
+	}
+	err := fmt.Errorf("%s buffer full, dropped %d lines", sink, b.dropped)
+	b.dropped = 0
+
+	return err
+}
@@ -2,146 +2,385 @@ package rrd2prom
 
 import (
 	"context"
+	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Metric represents a single data point from an RRD file
+// Metric represents a single data point from an RRD file. Name is the
+// metric name built by the manager's Namer, File the name of the RRD file
+// and Source the data source it was read from. The data source only shows
+// up in the name, so it's up to the name template to keep them apart.
+// Labels holds the file's labels on top of File, it's shared by every
+// metric from the same file and must not be modified. FileLabels are the
+// labels set on the file itself, which relabeling may have changed in
+// Labels, and are shared the same way. Type is the data
+// source's type, like COUNTER, or GAUGE for values the manager made up
+// such as rates. Timestamp is when the metric was collected and
+// LastUpdate when the RRD file was last written. Raw is the value before
+// any multiply and offset transform and Scale what it was multiplied by,
+// for sinks that work out deltas of counters themselves. Metrics that
+// didn't come from a data source have a Scale of 0.
 type Metric struct {
-	Name      string
-	Value     uint64
-	Source    string
-	Timestamp time.Time
+	Name       string
+	File       string
+	Value      float64
+	Raw        float64
+	Scale      float64
+	Source     string
+	Type       string
+	Labels     map[string]string
+	FileLabels map[string]string
+	Timestamp  time.Time
+	LastUpdate time.Time
+}
+
+// labelPairs returns the metric's labels, File included, as name, value
+// pairs
+func (metric Metric) labelPairs() [][2]string {
+	pairs := make([][2]string, 0, len(metric.Labels)+1)
+	if metric.File != "" {
+		pairs = append(pairs, [2]string{"file", metric.File})
+	}
+	for name, value := range metric.Labels {
+		if !reservedLabels[name] {
+			pairs = append(pairs, [2]string{name, value})
+		}
+	}
+
+	return pairs
 }
 
 // RRDManager handles multiple RRD files and their metric collection
 type RRDManager struct {
-	Files   []*RRDFile
-	Metrics chan Metric
-	Msgs    chan string
-	Errors  chan error
+	// sinks receive every batch of metrics, sinkMu guards against
+	// sending to them once they've been closed on shutdown
+	sinks       []*sinkRunner
+	sinkMu      sync.RWMutex
+	sinksClosed bool
 
-	done   chan struct{}
+	// onEvent is called for every event, events are queued on events and
+	// handed to onEvent by a dispatcher goroutine so they never block.
+	// eventsMu guards against queueing events once the dispatcher has
+	// been told to finish
+	onEvent       []func(Event)
+	events        chan Event
+	eventsDone    chan struct{}
+	eventsMu      sync.RWMutex
+	eventsClosed  bool
+	droppedEvents atomic.Uint64
+
+	// mu guards handlers, running and the context of the current run,
+	// which may be changed by Add/Remove/Replace while the manager is
+	// running
+	mu       sync.Mutex
+	handlers map[string]*handler
+	running  bool
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	// namer builds metric names and catches series that collide
+	namer *Namer
+
+	// rateMode says whether counters are turned into rates, rates keeps
+	// the previous read of each one to do so
+	rateMode RateMode
+	rates    rateTracker
+
+	// infoMetrics adds metrics describing each file's layout
+	infoMetrics bool
+
+	// sched decides when each handler is collected and runs it on a
+	// bounded pool of workers
+	sched *scheduler
+
+	// failureThreshold is how many failures in a row open a source's
+	// circuit, maxFailures how many get it dropped (0 for never)
+	failureThreshold int
+	maxFailures      int
+
+	// updateErrors counts every failed read by kind, including the ones
+	// the circuit breaker keeps quiet. counters holds the rest of the
+	// instrumentation of each source
+	updateErrors errorCounts
+	counters     sourceCounterSet
+
+	// configMu serializes ApplyConfig calls, sources holds the resolved
+	// config of every file that was added through it
+	configMu sync.Mutex
+	sources  map[string]SourceConfig
+
+	// lifeMu guards run, the current or most recent Start to shutdown
+	// cycle, see lifecycle.go. wg tracks the scheduler's goroutines
+	lifeMu sync.Mutex
+	run    *run
+	wg     sync.WaitGroup
+	ready  atomic.Bool
+}
+
+// handler tracks the collection of a single RRD file. each handler gets
+// its own context so it can be stopped without touching any of the
+// others. the scheduling fields are guarded by the scheduler's mutex.
+type handler struct {
+	file   *RRDFile
 	ctx    context.Context
 	cancel context.CancelFunc
-	wg     sync.WaitGroup
+	done   chan struct{}
+
+	next     time.Time // when the handler is next due
+	index    int       // position in the scheduler's queue, -1 if not queued
+	busy     bool      // a worker is collecting it right now
+	stopped  bool      // removed, don't reschedule
+	lastSeen time.Time // LastUpdate of the file as of the previous run
+	retries  int       // reads in a row that found the file not yet written
+	unphased bool      // only the first run has happened, see scheduler.add
+
+	health health
+}
+
+// interval returns how often the handler should run
+func (h *handler) interval() time.Duration {
+	// the interval can change under us when the file's step does
+	interval := h.file.Snapshot().Interval
+	if interval <= 0 {
+		return time.Minute
+	}
+	return interval
 }
 
 // NewRRDManager creates a new manager instance with the provided RRD files
-func NewRRDManager(files []*RRDFile) (*RRDManager, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-	
-	return &RRDManager{
-		Files:   files,
-		Metrics: make(chan Metric, 1000),
-		Msgs:    make(chan string, 1000),
-		Errors:  make(chan error, 1000),
-		done:    make(chan struct{}),
-		ctx:     ctx,
-		cancel:  cancel,
-	}, nil
-}
-
-// Run starts the manager and all RRD file handlers
-func (m *RRDManager) Run() error {
-	// first send an initial message that we're starting
-	m.Msgs <- "RRDManager starting up..."
-
-	// start a handler for each RRD file
-	for _, file := range m.Files {
-		m.startHandler(file)
-	}
-
-	// wait for done signal
-	<-m.done
-	
-	// cancel context for all handlers
-	m.cancel()
-	
-	// wait for all handlers to complete
-	m.wg.Wait()
-	
-	// send final message before closing channels
-	m.Msgs <- "RRDManager shutting down..."
-	
-	// close channels safely
-	m.closeChannels()
+func NewRRDManager(files []*RRDFile, opts ...Option) (*RRDManager, error) {
+	m := &RRDManager{
+		handlers: make(map[string]*handler),
+		sched:    newScheduler(),
+		ctx:      context.Background(),
+		cancel:   func() {},
+
+		failureThreshold: defaultFailureThreshold,
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	if m.namer == nil {
+		namer, err := NewNamer(NamingOptions{})
+		if err != nil {
+			return nil, err
+		}
+		m.namer = namer
+	}
+
+	for _, file := range files {
+		if err := m.Add(file); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// Files returns the RRD files currently managed, sorted by name.
+func (m *RRDManager) Files() []*RRDFile {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	files := make([]*RRDFile, 0, len(m.handlers))
+	for _, h := range m.handlers {
+		files = append(files, h.file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	return files
+}
+
+// manages reports whether a file called name is currently managed.
+func (m *RRDManager) manages(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, exists := m.handlers[name]
+	return exists
+}
+
+// Add registers an RRD file with the manager. If the manager is already
+// running a handler is started for it immediately, otherwise it will be
+// started by Start. Names must be unique across the manager.
+func (m *RRDManager) Add(file *RRDFile) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.handlers[file.Name]; exists {
+		return fmt.Errorf("rrd file %s is already managed", file.Name)
+	}
+
+	h := &handler{file: file}
+	m.handlers[file.Name] = h
+	if m.running {
+		m.startHandler(h)
+	}
 
 	return nil
 }
 
-// Stop signals the manager to stop all handlers and clean up
-func (m *RRDManager) Stop() {
-	close(m.done)
-}
-
-// startHandler creates and runs a goroutine to handle a single RRD file
-func (m *RRDManager) startHandler(rrdFile *RRDFile) {
-	m.wg.Add(1)
-	
-	go func() {
-		defer m.wg.Done()
-
-		// send initial message for this handler
-		m.Msgs <- "Starting handler for " + rrdFile.Name
-		
-		ticker := time.NewTicker(rrdFile.Interval)
-		defer ticker.Stop()
-
-		// do an initial update immediately
-		if err := rrdFile.Update(); err != nil {
-			m.Errors <- err
-		} else {
-			now := time.Now()
-			for dsName, ds := range rrdFile.DataSources {
-				m.Metrics <- Metric{
-					Name:      rrdFile.Name,
-					Value:     ds.LastValue,
-					Source:    dsName,
-					Timestamp: now,
-				}
-			}
-		}
+// Remove stops the handler for the RRD file called name and forgets about
+// it. It blocks until the handler goroutine has exited.
+func (m *RRDManager) Remove(name string) error {
+	m.mu.Lock()
+	h, exists := m.handlers[name]
+	if !exists {
+		m.mu.Unlock()
+		return fmt.Errorf("rrd file %s is not managed", name)
+	}
+	delete(m.handlers, name)
+	m.mu.Unlock()
+
+	m.stopHandler(h)
+
+	// let the sinks know the file is gone
+	m.namer.release(name)
+	m.rates.release(name)
+	m.counters.release(name)
+	m.forget(name)
+
+	return nil
+}
+
+// Replace swaps the RRD file with the same name as file for file itself,
+// stopping the old handler before the new one is started. If no file with
+// that name is managed yet, Replace behaves like Add.
+func (m *RRDManager) Replace(file *RRDFile) error {
+	m.mu.Lock()
+	old := m.handlers[file.Name]
+	delete(m.handlers, file.Name)
+	m.mu.Unlock()
+
+	if old != nil {
+		m.stopHandler(old)
+	}
+
+	return m.Add(file)
+}
+
+// runContext returns the context of the current run, which is cancelled
+// when the manager stops.
+func (m *RRDManager) runContext() context.Context {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.ctx
+}
+
+// startHandler schedules the collection of a single RRD file.
+// m.mu must be held by the caller.
+func (m *RRDManager) startHandler(h *handler) {
+	h.ctx, h.cancel = context.WithCancel(m.ctx)
+	h.done = make(chan struct{})
+	h.index = -1
+	h.stopped = false
+
+	m.emit(Event{Type: EventHandlerStarted, File: h.file.Name, Location: h.file.Location})
+	m.sched.add(h)
+}
+
+// stopHandler cancels a handler, if it was ever started, and takes it off
+// the schedule, waiting for any update in flight to finish.
+func (m *RRDManager) stopHandler(h *handler) {
+	if h.cancel == nil {
+		return
+	}
+	h.cancel()
+	m.sched.remove(h)
+	m.emit(Event{Type: EventHandlerStopped, File: h.file.Name, Location: h.file.Location})
+}
+
+// collect updates rrdFile and sends a metric for each of its data sources
+// to the sinks, returning how long the update took.
+func (m *RRDManager) collect(ctx context.Context, rrdFile *RRDFile) (time.Duration, error) {
+	// the per file timeout only bounds the read, sending the metrics on
+	// is up to the sinks
+	readCtx := ctx
+	if rrdFile.Timeout > 0 {
+		var cancel context.CancelFunc
+		readCtx, cancel = context.WithTimeout(ctx, rrdFile.Timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	err := rrdFile.UpdateContext(readCtx)
+	took := time.Since(start)
+
+	if err != nil {
+		return took, err
+	}
+
+	// the file has already switched over to its new schema, so carry on
+	// as normal: the batch below replaces all of its old metrics and the
+	// scheduler picks up the new interval on its own
+	if change := rrdFile.LastSchemaChange(); change != nil {
+		m.emit(Event{Type: EventSchemaChanged, File: rrdFile.Name, Location: rrdFile.Location, Schema: change})
+	}
+
+	// create a metric for each data source and send them to the sinks
+	snap := rrdFile.Snapshot()
+	now := time.Now()
 
-		for {
-			select {
-			case <-m.ctx.Done():
-				m.Msgs <- "Stopping handler for " + rrdFile.Name
-				return
-				
-			case <-ticker.C:
-				// update RRD file data
-				if err := rrdFile.Update(); err != nil {
-					m.Errors <- err
-					continue
-				}
-
-				m.Msgs <- "Updated " + rrdFile.Name + " RRD file"
-
-				// create and send metrics for each data source
-				now := time.Now()
-				for dsName, ds := range rrdFile.DataSources {
-					metric := Metric{
-						Name:      rrdFile.Name,
-						Value:     ds.LastValue,
-						Source:    dsName,
-						Timestamp: now,
-					}
-					
-					select {
-					case m.Metrics <- metric:
-					case <-m.ctx.Done():
-						return
-					}
-				}
+	// the data sources come back in order, so when two of them end up
+	// with the same name it's always the same one that wins
+	values := rrdFile.Transform.values(snap.DataSources)
+	values = m.rates.expand(m.rateMode, snap.Name, snap.LastUpdate, values)
+
+	metrics := make([]Metric, 0, len(values))
+	for _, v := range values {
+		ds := v.ds
+		nameFunc := m.namer.nameWithUnit
+		if v.rate {
+			nameFunc = m.namer.rateName
+		}
+		name, err := nameFunc(snap.Name, ds, v.unit)
+		if err != nil {
+			return took, err
+		}
+		metric := Metric{
+			Name:       name,
+			File:       snap.Name,
+			Value:      v.value,
+			Raw:        v.raw,
+			Scale:      v.scale,
+			Source:     ds.Name,
+			Type:       ds.Type,
+			Labels:     snap.Labels,
+			FileLabels: snap.Labels,
+			Timestamp:  now,
+			LastUpdate: snap.LastUpdate,
+		}
+		if rrdFile.Relabel != nil {
+			var keep bool
+			if metric, keep = rrdFile.Relabel.relabel(metric, ds.Type); !keep {
+				continue
 			}
+			metric.Name = m.namer.clean(metric.Name)
 		}
-	}()
+		metrics = append(metrics, metric)
+	}
+
+	if m.infoMetrics {
+		metrics = append(metrics, m.layoutMetrics(snap, now)...)
+	}
+
+	metrics, collisions := m.namer.claim(snap.Name, metrics)
+	for _, err := range collisions {
+		m.emit(Event{Type: EventNameCollision, File: snap.Name, Location: snap.Location, Err: err})
+	}
+
+	m.fanOut(ctx, rrdFile.Name, metrics)
+
+	return took, nil
 }
 
-// closeChannels safely closes all channels used by the manager
-func (m *RRDManager) closeChannels() {
-	close(m.Metrics)
-	close(m.Msgs)
-	close(m.Errors)
+// SchedulerStats returns how the worker pool is keeping up.
+func (m *RRDManager) SchedulerStats() SchedulerStats {
+	return m.sched.snapshot()
 }
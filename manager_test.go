@@ -0,0 +1,330 @@
+package rrd2prom_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jessegalley/rrd2prom"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRRDs serves canned rrd.Info maps keyed by location so the manager
+// can be exercised without real RRD files on disk.
+type fakeRRDs struct {
+	mu    sync.Mutex
+	infos map[string]map[string]interface{}
+}
+
+func newFakeRRDs(t *testing.T) *fakeRRDs {
+	t.Helper()
+
+	f := &fakeRRDs{infos: make(map[string]map[string]interface{})}
+	t.Cleanup(rrd2prom.SetRRDInfo(f.info))
+
+	return f
+}
+
+// set registers location as an RRD with a single COUNTER data source
+func (f *fakeRRDs) set(location string, lastUpdate uint, value uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.infos[location] = map[string]interface{}{
+		"step":        uint(60),
+		"last_update": lastUpdate,
+		"ds.index":    map[string]interface{}{"traffic_in": uint(0)},
+		"ds.type":     map[string]interface{}{"traffic_in": "COUNTER"},
+		"ds.last_ds":  map[string]interface{}{"traffic_in": fmt.Sprint(value)},
+	}
+}
+
+func (f *fakeRRDs) info(location string) (map[string]interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, ok := f.infos[location]
+	if !ok {
+		return nil, fmt.Errorf("no such rrd: %s", location)
+	}
+
+	return info, nil
+}
+
+// newFastFile opens a fake RRD file and shortens its interval so handlers
+// tick quickly during tests
+func newFastFile(t *testing.T, f *fakeRRDs, name string) *rrd2prom.RRDFile {
+	t.Helper()
+
+	f.set(name+".rrd", 1735589344, 42)
+	rrdFile, err := rrd2prom.NewRRDFile(name+".rrd", name)
+	require.NoError(t, err)
+	rrdFile.Interval = 10 * time.Millisecond
+
+	return rrdFile
+}
+
+// newManager creates a manager for files that delivers its metrics to
+// the returned ChanSink, on top of any sinks set in opts
+func newManager(t *testing.T, files []*rrd2prom.RRDFile, opts ...rrd2prom.Option) (*rrd2prom.RRDManager, *rrd2prom.ChanSink) {
+	t.Helper()
+
+	sink := rrd2prom.NewChanSink(1000)
+	opts = append(opts, rrd2prom.WithSink(sink, rrd2prom.SinkOptions{Name: "test"}))
+
+	m, err := rrd2prom.NewRRDManager(files, opts...)
+	require.NoError(t, err)
+
+	return m, sink
+}
+
+// startManager starts m and stops it when the test
+// finishes, draining sink so shutdown can't get stuck on it
+func startManager(t *testing.T, m *rrd2prom.RRDManager, sink *rrd2prom.ChanSink) {
+	t.Helper()
+
+	require.NoError(t, m.Start(context.Background()))
+
+	t.Cleanup(func() {
+		m.Stop()
+		go func() {
+			for range sink.C {
+			}
+		}()
+		m.Wait()
+	})
+}
+
+// waitForMetric blocks until a metric from the file called name is
+// received
+func waitForMetric(t *testing.T, sink *rrd2prom.ChanSink, name string) {
+	t.Helper()
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case metric := <-sink.C:
+			if metric.File == name {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for a metric from %s", name)
+		}
+	}
+}
+
+func TestRRDManager_Add(t *testing.T) {
+	fakes := newFakeRRDs(t)
+
+	m, sink := newManager(t, []*rrd2prom.RRDFile{newFastFile(t, fakes, "port1")})
+	startManager(t, m, sink)
+
+	waitForMetric(t, sink, "port1")
+
+	// files added at runtime get a handler straight away
+	require.NoError(t, m.Add(newFastFile(t, fakes, "port2")))
+	waitForMetric(t, sink, "port2")
+
+	// names must stay unique
+	assert.Error(t, m.Add(newFastFile(t, fakes, "port2")))
+	assert.Len(t, m.Files(), 2)
+}
+
+func TestRRDManager_Remove(t *testing.T) {
+	fakes := newFakeRRDs(t)
+
+	m, sink := newManager(t, []*rrd2prom.RRDFile{
+		newFastFile(t, fakes, "port1"),
+		newFastFile(t, fakes, "port2"),
+	})
+	startManager(t, m, sink)
+
+	waitForMetric(t, sink, "port1")
+	require.NoError(t, m.Remove("port1"))
+	assert.Error(t, m.Remove("port1"))
+
+	files := m.Files()
+	require.Len(t, files, 1)
+	assert.Equal(t, "port2", files[0].Name)
+
+	// the remaining handler keeps going
+	waitForMetric(t, sink, "port2")
+}
+
+func TestRRDManager_Replace(t *testing.T) {
+	fakes := newFakeRRDs(t)
+
+	m, sink := newManager(t, []*rrd2prom.RRDFile{newFastFile(t, fakes, "port1")})
+	startManager(t, m, sink)
+
+	replacement := newFastFile(t, fakes, "port1")
+	require.NoError(t, m.Replace(replacement))
+
+	files := m.Files()
+	require.Len(t, files, 1)
+	assert.Same(t, replacement, files[0])
+	waitForMetric(t, sink, "port1")
+
+	// replacing a name that isn't managed yet just adds it
+	require.NoError(t, m.Replace(newFastFile(t, fakes, "port3")))
+	assert.Len(t, m.Files(), 2)
+}
+
+func TestRRDManager_AddBeforeRun(t *testing.T) {
+	fakes := newFakeRRDs(t)
+
+	m, sink := newManager(t, nil)
+
+	// handlers registered before Run are started by Run
+	require.NoError(t, m.Add(newFastFile(t, fakes, "port1")))
+	require.NoError(t, m.Remove("port1"))
+	require.NoError(t, m.Add(newFastFile(t, fakes, "port2")))
+	startManager(t, m, sink)
+
+	waitForMetric(t, sink, "port2")
+}
+
+func TestRRDManager_Events(t *testing.T) {
+	fakes := newFakeRRDs(t)
+
+	events := make(chan rrd2prom.Event, 100)
+	m, sink := newManager(t,
+		[]*rrd2prom.RRDFile{newFastFile(t, fakes, "port1")},
+		rrd2prom.WithEventHandler(func(e rrd2prom.Event) {
+			select {
+			case events <- e:
+			default:
+			}
+		}),
+	)
+	startManager(t, m, sink)
+
+	// waitForEvent blocks until an event of type typ is seen
+	waitForEvent := func(typ rrd2prom.EventType) rrd2prom.Event {
+		timeout := time.After(2 * time.Second)
+		for {
+			select {
+			case e := <-events:
+				if e.Type == typ {
+					return e
+				}
+			case <-timeout:
+				t.Fatalf("timed out waiting for a %s event", typ)
+			}
+		}
+	}
+
+	waitForEvent(rrd2prom.EventHandlerStarted)
+	ok := waitForEvent(rrd2prom.EventUpdateOK)
+	assert.Equal(t, "port1", ok.File)
+	assert.Equal(t, "port1.rrd", ok.Location)
+	assert.NoError(t, ok.Err)
+
+	// break the file underneath the handler
+	fakes.mu.Lock()
+	delete(fakes.infos, "port1.rrd")
+	fakes.mu.Unlock()
+
+	failed := waitForEvent(rrd2prom.EventUpdateFailed)
+	assert.Equal(t, "port1", failed.File)
+	assert.Error(t, failed.Err)
+	assert.NotEmpty(t, failed.ErrKind)
+
+	require.NoError(t, m.Remove("port1"))
+	waitForEvent(rrd2prom.EventHandlerStopped)
+}
+
+func TestRRDManager_SlowEventHandler(t *testing.T) {
+	fakes := newFakeRRDs(t)
+
+	// an event handler that never returns must not hold up collection
+	stuck := make(chan struct{})
+
+	m, sink := newManager(t,
+		[]*rrd2prom.RRDFile{newFastFile(t, fakes, "port1")},
+		rrd2prom.WithEventHandler(func(rrd2prom.Event) { <-stuck }),
+	)
+	startManager(t, m, sink)
+	t.Cleanup(func() { close(stuck) })
+
+	for i := 0; i < 5; i++ {
+		waitForMetric(t, sink, "port1")
+	}
+	require.NoError(t, m.Remove("port1"))
+}
+
+func TestRRDManager_SchemaChange(t *testing.T) {
+	fakes := newFakeRRDs(t)
+	events := newEventRecorder()
+	store := rrd2prom.NewStore()
+
+	m, sink := newManager(t, []*rrd2prom.RRDFile{newFastFile(t, fakes, "port1")},
+		events.option(),
+		rrd2prom.WithSink(store, rrd2prom.SinkOptions{Name: "store"}),
+	)
+	startManager(t, m, sink)
+	waitForMetric(t, sink, "port1")
+
+	// tune in a second data source, swapping the whole info map since
+	// the handler may be reading the old one
+	fakes.mu.Lock()
+	fakes.infos["port1.rrd"] = map[string]interface{}{
+		"step":        uint(60),
+		"last_update": uint(1735589344),
+		"ds.index":    map[string]interface{}{"traffic_in": uint(0), "traffic_out": uint(1)},
+		"ds.type":     map[string]interface{}{"traffic_in": "COUNTER", "traffic_out": "COUNTER"},
+		"ds.last_ds":  map[string]interface{}{"traffic_in": "42", "traffic_out": "7"},
+	}
+	fakes.mu.Unlock()
+
+	seen := events.waitFor(t, rrd2prom.EventSchemaChanged)
+	change := seen[len(seen)-1]
+	require.NotNil(t, change.Schema)
+	assert.Equal(t, []string{"traffic_out"}, change.Schema.Added)
+	assert.NoError(t, change.Err)
+
+	// it's not a failure, and the new data source shows up
+	events.waitFor(t, rrd2prom.EventUpdateOK)
+	assert.Eventually(t, func() bool { return len(store.Metrics()) == 2 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, rrd2prom.CircuitClosed, m.SourceStatuses()[0].State)
+}
+
+func TestRRDManager_Timeout(t *testing.T) {
+	fakes := newFakeRRDs(t)
+	file := newFastFile(t, fakes, "port1")
+	file.Timeout = 20 * time.Millisecond
+	events := newEventRecorder()
+
+	// every read from here on hangs until the test is over
+	release := make(chan struct{})
+	t.Cleanup(rrd2prom.SetRRDInfo(func(location string) (map[string]interface{}, error) {
+		<-release
+		return fakes.info(location)
+	}))
+
+	m, sink := newManager(t, []*rrd2prom.RRDFile{file}, events.option())
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		m.Run()
+	}()
+	go func() {
+		for range sink.C {
+		}
+	}()
+
+	seen := events.waitFor(t, rrd2prom.EventUpdateFailed)
+	assert.Equal(t, "timeout", seen[len(seen)-1].ErrKind)
+
+	// stopping doesn't wait on the hung read either
+	m.Stop()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("Stop blocked on a hung read")
+	}
+	close(release)
+}
@@ -0,0 +1,295 @@
+package rrd2prom
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"unicode/utf8"
+)
+
+// defaults for NamingOptions
+const (
+	DefaultNameTemplate = "{{.Prefix}}_{{.DS}}{{with .Unit}}_{{.}}{{end}}"
+	DefaultNamePrefix   = "rrd"
+)
+
+// NamingOptions controls how metric names are built from RRD files.
+type NamingOptions struct {
+	// Template is a text/template producing the metric name for each data
+	// source. It can use .Prefix, .File (the RRD file's name), .DS (the
+	// data source's name), .Type (the data source's type, like COUNTER)
+	// and .Unit (the unit set by the data source's transform, if any).
+	// Defaults to DefaultNameTemplate.
+	Template string
+	// Prefix is passed to the template as .Prefix, defaults to
+	// DefaultNamePrefix.
+	Prefix string
+	// UTF8 keeps names as they come out of the template instead of
+	// replacing characters that aren't allowed in classic Prometheus
+	// names. Names that still aren't valid classic names are written
+	// quoted, as the OpenMetrics UTF-8 names extension allows. Series are
+	// still checked for collisions by their escaped names, since scrapers
+	// that don't take UTF-8 names get those.
+	UTF8 bool
+}
+
+// nameData is what name templates are executed against
+type nameData struct {
+	Prefix string
+	File   string
+	DS     string
+	Type   string
+	Unit   string
+}
+
+// Namer turns RRD data sources into metric names and keeps track of which
+// file every series came from, so two files can't quietly overwrite each
+// other's series.
+type Namer struct {
+	tmpl   *template.Template
+	prefix string
+	utf8   bool
+
+	// usesUnit is whether the template's names change with .Unit
+	usesUnit bool
+
+	// mu guards owners, the file that produced each series, and byFile,
+	// the series each file produced last time along with the ones it
+	// collided on
+	mu     sync.Mutex
+	owners map[string]string
+	byFile map[string]*fileSeries
+}
+
+// fileSeries is what a single file claimed in the Namer
+type fileSeries struct {
+	keys       []string
+	collisions map[string]bool
+}
+
+// NewNamer creates a Namer, checking that the template is valid.
+func NewNamer(opts NamingOptions) (*Namer, error) {
+	if opts.Template == "" {
+		opts.Template = DefaultNameTemplate
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = DefaultNamePrefix
+	}
+
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(opts.Template)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name template: %w", err)
+	}
+
+	n := &Namer{
+		tmpl:   tmpl,
+		prefix: opts.Prefix,
+		utf8:   opts.UTF8,
+		owners: make(map[string]string),
+		byFile: make(map[string]*fileSeries),
+	}
+
+	// try it out so mistakes like unknown fields show up now rather than
+	// on the first collection
+	sample := RRDDataSource{Name: "ds", Type: "GAUGE"}
+	plain, err := n.Name("file", sample)
+	if err != nil {
+		return nil, err
+	}
+	withUnit, err := n.nameWithUnit("file", sample, rateUnit)
+	if err != nil {
+		return nil, err
+	}
+	n.usesUnit = plain != withUnit
+
+	return n, nil
+}
+
+// WithNamer has the manager name metrics with n instead of the default
+// Namer.
+func WithNamer(n *Namer) Option {
+	return func(m *RRDManager) {
+		if n != nil {
+			m.namer = n
+		}
+	}
+}
+
+// Name returns the metric name for a data source of the file called file.
+func (n *Namer) Name(file string, ds RRDDataSource) (string, error) {
+	return n.nameWithUnit(file, ds, "")
+}
+
+// nameWithUnit is Name for a data source whose transformed value is in
+// unit
+func (n *Namer) nameWithUnit(file string, ds RRDDataSource, unit string) (string, error) {
+	var b strings.Builder
+	data := nameData{Prefix: n.prefix, File: file, DS: ds.Name, Type: ds.Type, Unit: unit}
+	if err := n.tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("invalid name template: %w", err)
+	}
+
+	name := n.clean(b.String())
+	if name == "" || !utf8.ValidString(name) {
+		return "", fmt.Errorf("invalid metric name %q for %s of %s", name, ds.Name, file)
+	}
+
+	return name, nil
+}
+
+// rateName is the name of the rate of a data source whose transformed
+// value is in unit. It's nameWithUnit with the rate's unit, unless the
+// template ignores units, in which case the rate's unit is appended to
+// the name so it can't collide with the raw value.
+func (n *Namer) rateName(file string, ds RRDDataSource, unit string) (string, error) {
+	name, err := n.nameWithUnit(file, ds, unit)
+	if err != nil || n.usesUnit {
+		return name, err
+	}
+
+	return n.clean(name + "_" + rateUnit), nil
+}
+
+// clean makes name usable as a metric name, unless UTF-8 names are
+// allowed
+func (n *Namer) clean(name string) string {
+	if n.utf8 {
+		return name
+	}
+
+	return sanitizeName(name)
+}
+
+// claim registers the series in a batch from file, dropping the ones that
+// collide with a series from another file or with another series in the
+// same batch. Each collision is only reported the first time it's seen.
+func (n *Namer) claim(file string, metrics []Metric) ([]Metric, []error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	prev := n.byFile[file]
+	if prev == nil {
+		prev = &fileSeries{collisions: make(map[string]bool)}
+	}
+	next := &fileSeries{collisions: make(map[string]bool)}
+
+	var errs []error
+	seen := make(map[string]string, len(metrics))
+	kept := metrics[:0]
+	for _, metric := range metrics {
+		key := seriesKey(metric)
+		if n.utf8 {
+			// series that only differ in characters classic names can't
+			// have still collide where they're written escaped
+			key = legacyKey(metric)
+		}
+
+		var err error
+		if ds, dup := seen[key]; dup {
+			err = fmt.Errorf("%w: %s from %s of %s is already used by %s", ErrNameCollision, metric.Name, metric.Source, file, ds)
+		} else if owner, ok := n.owners[key]; ok && owner != file {
+			err = fmt.Errorf("%w: %s from %s of %s is already used by file %s", ErrNameCollision, metric.Name, metric.Source, file, owner)
+		}
+		if err != nil {
+			if !prev.collisions[key] {
+				errs = append(errs, err)
+			}
+			next.collisions[key] = true
+			continue
+		}
+
+		seen[key] = metric.Source
+		n.owners[key] = file
+		next.keys = append(next.keys, key)
+		kept = append(kept, metric)
+	}
+
+	// give up series the file no longer produces
+	for _, key := range prev.keys {
+		if _, still := seen[key]; !still && n.owners[key] == file {
+			delete(n.owners, key)
+		}
+	}
+	n.byFile[file] = next
+
+	return kept, errs
+}
+
+// release forgets every series from file
+func (n *Namer) release(file string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if prev := n.byFile[file]; prev != nil {
+		for _, key := range prev.keys {
+			if n.owners[key] == file {
+				delete(n.owners, key)
+			}
+		}
+	}
+	delete(n.byFile, file)
+}
+
+// seriesKey identifies a metric's series by its name and labels
+func seriesKey(metric Metric) string {
+	labels := metric.labelPairs()
+	sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+
+	var b strings.Builder
+	b.WriteString(metric.Name)
+	for _, label := range labels {
+		b.WriteByte(0xff)
+		b.WriteString(label[0])
+		b.WriteByte(0xfe)
+		b.WriteString(label[1])
+	}
+
+	return b.String()
+}
+
+// legacyKey is seriesKey for the metric's name and label names as
+// WriteLegacyText writes them
+func legacyKey(metric Metric) string {
+	legacy := Metric{Name: sanitizeName(metric.Name), File: metric.File, Labels: make(map[string]string, len(metric.Labels))}
+	for name, value := range metric.Labels {
+		legacy.Labels[legacyLabelName(name)] = value
+	}
+
+	return seriesKey(legacy)
+}
+
+// legacyLabelName replaces every character that isn't allowed in a
+// classic Prometheus label name with an underscore
+func legacyLabelName(name string) string {
+	return strings.ReplaceAll(sanitizeName(name), ":", "_")
+}
+
+// sanitizeName replaces every character that isn't allowed in a classic
+// Prometheus metric name with an underscore, and makes sure the name
+// doesn't start with a digit.
+func sanitizeName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r == '_' || r == ':' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z'):
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+
+	return b.String()
+}
+
+// isLegacyName reports whether name is a valid classic Prometheus metric
+// or label name, which can be written without quoting.
+func isLegacyName(name string) bool {
+	return name != "" && sanitizeName(name) == name
+}
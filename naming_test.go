@@ -0,0 +1,99 @@
+package rrd2prom_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/jessegalley/rrd2prom"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamer(t *testing.T) {
+	ds := rrd2prom.RRDDataSource{Name: "traffic_in", Type: "COUNTER"}
+
+	tests := []struct {
+		name    string
+		opts    rrd2prom.NamingOptions
+		file    string
+		want    string
+		wantErr bool
+	}{
+		{"Default", rrd2prom.NamingOptions{}, "eth1/24", "rrd_traffic_in", false},
+		{"Prefix", rrd2prom.NamingOptions{Prefix: "cacti"}, "eth1/24", "cacti_traffic_in", false},
+		{"Sanitized", rrd2prom.NamingOptions{Template: "{{.File}}_{{.DS}}"}, "eth1/24", "eth1_24_traffic_in", false},
+		{"LeadingDigit", rrd2prom.NamingOptions{Template: "{{.File}}"}, "1st-floor", "_1st_floor", false},
+		{"Type", rrd2prom.NamingOptions{Template: "{{.Prefix}}_{{.DS}}_{{.Type}}"}, "port1", "rrd_traffic_in_COUNTER", false},
+		{"UTF8", rrd2prom.NamingOptions{Template: "{{.File}}.{{.DS}}", UTF8: true}, "eth1/24", "eth1/24.traffic_in", false},
+		{"BadTemplate", rrd2prom.NamingOptions{Template: "{{.Prefix"}, "port1", "", true},
+		{"UnknownField", rrd2prom.NamingOptions{Template: "{{.Bogus}}"}, "port1", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			namer, err := rrd2prom.NewNamer(tt.opts)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			name, err := namer.Name(tt.file, ds)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, name)
+		})
+	}
+}
+
+func TestRRDManager_NameCollision(t *testing.T) {
+	// with UTF-8 names the names differ, but not once they're escaped
+	for name, utf8 := range map[string]bool{"Legacy": false, "UTF8": true} {
+		t.Run(name, func(t *testing.T) {
+			fakes := newFakeRRDs(t)
+			events := newEventRecorder()
+			store := rrd2prom.NewStore()
+
+			// two data sources that sanitize to the same name
+			fakes.set("port1.rrd", 1735589344, 1)
+			fakes.mu.Lock()
+			fakes.infos["port1.rrd"]["ds.index"] = map[string]interface{}{"traffic-in": uint(0), "traffic_in": uint(1)}
+			fakes.infos["port1.rrd"]["ds.type"] = map[string]interface{}{"traffic-in": "COUNTER", "traffic_in": "COUNTER"}
+			fakes.infos["port1.rrd"]["ds.last_ds"] = map[string]interface{}{"traffic-in": "1", "traffic_in": "2"}
+			fakes.mu.Unlock()
+
+			file, err := rrd2prom.NewRRDFile("port1.rrd", "port1")
+			require.NoError(t, err)
+			file.Interval = 10 * time.Millisecond
+
+			namer, err := rrd2prom.NewNamer(rrd2prom.NamingOptions{Template: "{{.Prefix}}_{{.DS}}", UTF8: utf8})
+			require.NoError(t, err)
+
+			m, sink := newManager(t, []*rrd2prom.RRDFile{file},
+				events.option(),
+				rrd2prom.WithNamer(namer),
+				rrd2prom.WithSink(store, rrd2prom.SinkOptions{Name: "store"}),
+			)
+			startManager(t, m, sink)
+
+			seen := events.waitFor(t, rrd2prom.EventNameCollision)
+			collision := seen[len(seen)-1]
+			assert.ErrorIs(t, collision.Err, rrd2prom.ErrNameCollision)
+			assert.Equal(t, "name_collision", collision.ErrKind)
+
+			// the first data source keeps the name, and the collision is only
+			// reported once
+			assert.Eventually(t, func() bool { return len(store.Metrics()) == 1 }, 2*time.Second, 5*time.Millisecond)
+			assert.Equal(t, "traffic-in", store.Metrics()[0].Source)
+
+			for i := 0; i < 3; i++ {
+				seen = events.waitFor(t, rrd2prom.EventUpdateOK)
+				assert.Zero(t, countType(seen, rrd2prom.EventNameCollision))
+			}
+
+			var buf bytes.Buffer
+			require.NoError(t, store.WriteLegacyText(&buf))
+			assert.Equal(t, "rrd_traffic_in{file=\"port1\"} 1\n", buf.String())
+		})
+	}
+}
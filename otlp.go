@@ -0,0 +1,487 @@
+package rrd2prom
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLPOptions configures an OTLPSink. Only Endpoint is required.
+type OTLPOptions struct {
+	// Endpoint is the full URL metrics are posted to, like
+	// http://collector:4318/v1/metrics
+	Endpoint string
+	// Headers are added to every request, for authentication
+	Headers map[string]string
+	// BatchSize is how many metrics are queued before they're sent,
+	// defaults to 1000
+	BatchSize int
+	// FlushInterval is the longest metrics are queued for, defaults to 10s
+	FlushInterval time.Duration
+	// MaxRetries is how many times a failed export is retried, defaults
+	// to 3, negative for never. RetryBackoff is the wait before the first
+	// retry, doubling after each one, defaults to 1s
+	MaxRetries   int
+	RetryBackoff time.Duration
+	// Timeout bounds each request, defaults to 10s. It's ignored when
+	// Client is set
+	Timeout time.Duration
+	Client  *http.Client
+}
+
+// OTLPSink is a Sink that exports metrics to an OpenTelemetry collector
+// with OTLP over HTTP, encoded as protobuf. Metrics are queued and sent
+// once BatchSize of them are waiting or every FlushInterval, whichever
+// comes first, with one resource per RRD file.
+//
+// COUNTER data sources become cumulative monotonic sums and DERIVE ones
+// cumulative non-monotonic sums, everything else, rates included, is a
+// gauge. The start of a sum is when it was first seen, and moves up when
+// a COUNTER goes down, since that's a reset as far as OTLP is concerned.
+// The file and the labels set on it become resource attributes, labels
+// added or changed by relabeling data point attributes. Points are
+// timestamped with the file's last update, and unknown values are sent
+// flagged as having no recorded value.
+//
+// Exports failing on the network or with 429, 502, 503 or 504 are
+// retried, anything else is dropped. Failed background flushes are
+// returned by the next WriteMetrics. Close stops the background flushing,
+// which starts again on the next write.
+type OTLPSink struct {
+	opts   OTLPOptions
+	client *http.Client
+
+	// mu guards pending, points, err and starts, along with stop and
+	// done, which are set while the background flushing runs
+	mu      sync.Mutex
+	pending []otlpBatch
+	points  int
+	err     error
+	starts  map[string]map[string]otlpStart
+	stop    chan struct{}
+	done    chan struct{}
+
+	// exportMu keeps exports in order
+	exportMu sync.Mutex
+}
+
+// otlpBatch is a batch of metrics from one file waiting to be exported
+type otlpBatch struct {
+	file    string
+	metrics []Metric
+}
+
+// otlpStart is when a sum's series started, and its last point
+type otlpStart struct {
+	start time.Time
+	at    time.Time
+	last  float64
+}
+
+// NewOTLPSink creates an OTLPSink and starts flushing it in the
+// background.
+func NewOTLPSink(opts OTLPOptions) (*OTLPSink, error) {
+	if !strings.HasPrefix(opts.Endpoint, "http://") && !strings.HasPrefix(opts.Endpoint, "https://") {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q", opts.Endpoint)
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 10 * time.Second
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = 3
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	client := opts.Client
+	if client == nil {
+		client = &http.Client{Timeout: opts.Timeout}
+	}
+
+	s := &OTLPSink{
+		opts:   opts,
+		client: client,
+		starts: make(map[string]map[string]otlpStart),
+	}
+	s.mu.Lock()
+	s.start()
+	s.mu.Unlock()
+
+	return s, nil
+}
+
+// start starts the background flushing if it isn't running. s.mu must be
+// held by the caller.
+func (s *OTLPSink) start() {
+	if s.stop != nil {
+		return
+	}
+	s.stop, s.done = make(chan struct{}), make(chan struct{})
+	go s.loop(s.stop, s.done)
+}
+
+// loop flushes the sink every FlushInterval until stop is closed
+func (s *OTLPSink) loop(stop, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(s.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := s.Flush(context.Background()); err != nil {
+				s.mu.Lock()
+				s.err = err
+				s.mu.Unlock()
+			}
+		}
+	}
+}
+
+// WriteMetrics implements Sink.
+func (s *OTLPSink) WriteMetrics(file string, metrics []Metric) error {
+	s.mu.Lock()
+	if len(metrics) == 0 {
+		// the file is gone, so are its series
+		delete(s.starts, file)
+		kept := s.pending[:0]
+		for _, b := range s.pending {
+			if b.file != file {
+				kept = append(kept, b)
+			}
+		}
+		s.pending = kept
+		s.mu.Unlock()
+		return nil
+	}
+
+	s.start()
+	s.pending = append(s.pending, otlpBatch{file: file, metrics: metrics})
+	s.points += len(metrics)
+	full := s.points >= s.opts.BatchSize
+	err := s.err
+	s.err = nil
+	s.mu.Unlock()
+
+	if full {
+		err = errors.Join(err, s.Flush(context.Background()))
+	}
+
+	return err
+}
+
+// Flush exports everything queued right away. Metrics that couldn't be
+// exported are dropped.
+func (s *OTLPSink) Flush(ctx context.Context) error {
+	s.exportMu.Lock()
+	defer s.exportMu.Unlock()
+
+	s.mu.Lock()
+	if len(s.pending) == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	body := s.encode(s.pending)
+	s.pending, s.points = nil, 0
+	s.mu.Unlock()
+
+	return s.export(ctx, body)
+}
+
+// Close stops the background flushing and exports what's left. The sink
+// can still be written to afterwards.
+func (s *OTLPSink) Close() error {
+	s.mu.Lock()
+	stop, done := s.stop, s.done
+	s.stop, s.done = nil, nil
+	s.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+
+	return s.Flush(context.Background())
+}
+
+// export posts body to the endpoint, retrying as long as it makes sense
+func (s *OTLPSink) export(ctx context.Context, body []byte) error {
+	for attempt := 0; ; attempt++ {
+		wait, retry, err := s.send(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || s.opts.MaxRetries < 0 || attempt >= s.opts.MaxRetries {
+			return err
+		}
+		if wait <= 0 {
+			wait = s.opts.RetryBackoff << attempt
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// send makes a single export request. It returns whether a failed one can
+// be retried, and how long the server asked to wait before doing so.
+func (s *OTLPSink) send(ctx context.Context, body []byte) (time.Duration, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.opts.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, fmt.Errorf("couldn't export to %s: %w", s.opts.Endpoint, err)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for name, value := range s.opts.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, ctx.Err() == nil, fmt.Errorf("couldn't export to %s: %w", s.opts.Endpoint, err)
+	}
+	defer resp.Body.Close()
+	// the response is a protobuf message we've no use for
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	if resp.StatusCode/100 == 2 {
+		return 0, false, nil
+	}
+
+	err = fmt.Errorf("couldn't export to %s: bad status: %s", s.opts.Endpoint, resp.Status)
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/") {
+		err = fmt.Errorf("%w: %s", err, strings.TrimSpace(string(msg)))
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		secs, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return time.Duration(secs) * time.Second, true, err
+	default:
+		return 0, false, err
+	}
+}
+
+// OTLP enum and flag values, from opentelemetry/proto/metrics/v1
+const (
+	otlpTemporalityCumulative = 2
+	otlpFlagNoRecordedValue   = 1
+)
+
+// encode builds an ExportMetricsServiceRequest out of batches. s.mu must
+// be held by the caller.
+func (s *OTLPSink) encode(batches []otlpBatch) []byte {
+	var req protoBuffer
+	for _, b := range batches {
+		req.message(1, func(rm *protoBuffer) { s.encodeResource(rm, b) })
+	}
+
+	return req
+}
+
+// encodeResource encodes the metrics of a single batch as ResourceMetrics
+func (s *OTLPSink) encodeResource(rm *protoBuffer, b otlpBatch) {
+	fileLabels := resourceLabels(b.file, b.metrics[0].FileLabels)
+
+	rm.message(1, func(resource *protoBuffer) {
+		resource.keyValue(1, "service.name", "rrd2prom")
+		for _, pair := range fileLabels {
+			resource.keyValue(1, pair[0], pair[1])
+		}
+	})
+
+	// points of the same metric go together, in the order they came
+	var names []string
+	byName := make(map[string][]Metric)
+	for _, metric := range b.metrics {
+		if _, seen := byName[metric.Name]; !seen {
+			names = append(names, metric.Name)
+		}
+		byName[metric.Name] = append(byName[metric.Name], metric)
+	}
+
+	rm.message(2, func(sm *protoBuffer) {
+		sm.message(1, func(scope *protoBuffer) {
+			scope.string(1, "rrd2prom")
+			scope.string(2, Version)
+		})
+		for _, name := range names {
+			sm.message(2, func(mb *protoBuffer) { s.encodeMetric(mb, b.file, name, byName[name], fileLabels) })
+		}
+	})
+}
+
+// encodeMetric encodes the points of the metric called name as a Metric,
+// leaving out the labels already on the resource
+func (s *OTLPSink) encodeMetric(mb *protoBuffer, file, name string, metrics []Metric, fileLabels [][2]string) {
+	mb.string(1, name)
+
+	var sum, monotonic bool
+	switch metrics[0].Type {
+	case "COUNTER":
+		sum, monotonic = true, true
+	case "DERIVE":
+		sum = true
+	}
+
+	points := func(data *protoBuffer) {
+		for _, metric := range metrics {
+			attrs := pointLabels(metric, fileLabels)
+			at := metric.LastUpdate
+			if at.IsZero() {
+				at = metric.Timestamp
+			}
+
+			data.message(1, func(dp *protoBuffer) {
+				if sum {
+					dp.fixed64(2, unixNano(s.seriesStart(file, name, attrs, at, metric.Value, monotonic)))
+				}
+				dp.fixed64(3, unixNano(at))
+				if math.IsNaN(metric.Value) {
+					dp.varint(8, otlpFlagNoRecordedValue)
+				} else {
+					dp.fixed64(4, math.Float64bits(metric.Value))
+				}
+				for _, pair := range attrs {
+					dp.keyValue(7, pair[0], pair[1])
+				}
+			})
+		}
+	}
+
+	if !sum {
+		mb.message(5, points)
+		return
+	}
+	mb.message(7, func(data *protoBuffer) {
+		points(data)
+		data.varint(2, otlpTemporalityCumulative)
+		if monotonic {
+			data.varint(3, 1)
+		}
+	})
+}
+
+// seriesStart returns the start time of a sum's point with value at at,
+// a decrease of a monotonic sum starting it over from the previous point
+func (s *OTLPSink) seriesStart(file, name string, attrs [][2]string, at time.Time, value float64, monotonic bool) time.Time {
+	var key strings.Builder
+	key.WriteString(name)
+	for _, pair := range attrs {
+		key.WriteString("\xff" + pair[0] + "\xff" + pair[1])
+	}
+
+	series := s.starts[file]
+	if series == nil {
+		series = make(map[string]otlpStart)
+		s.starts[file] = series
+	}
+
+	prev, seen := series[key.String()]
+	switch {
+	case !seen:
+		prev = otlpStart{start: at, at: at, last: value}
+	case math.IsNaN(value) || !at.After(prev.at):
+		return prev.start
+	case monotonic && value < prev.last:
+		prev.start = prev.at
+	}
+	prev.at, prev.last = at, value
+	series[key.String()] = prev
+
+	return prev.start
+}
+
+// resourceLabels returns file and the labels set on it, sorted by name
+func resourceLabels(file string, labels map[string]string) [][2]string {
+	pairs := Metric{File: file, Labels: labels}.labelPairs()
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+
+	return pairs
+}
+
+// pointLabels returns the labels of metric that aren't in fileLabels
+// with the same value, sorted by name
+func pointLabels(metric Metric, fileLabels [][2]string) [][2]string {
+	var pairs [][2]string
+	for _, pair := range metric.labelPairs() {
+		i := sort.Search(len(fileLabels), func(i int) bool { return fileLabels[i][0] >= pair[0] })
+		if i < len(fileLabels) && fileLabels[i] == pair {
+			continue
+		}
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+
+	return pairs
+}
+
+// unixNano returns t in nanoseconds since the epoch, as OTLP wants it
+func unixNano(t time.Time) uint64 {
+	return uint64(t.UnixNano())
+}
+
+// protoBuffer is just enough of a protobuf encoder for OTLP
+type protoBuffer []byte
+
+// tag appends the key of field with the given wire type
+func (b *protoBuffer) tag(field, wire int) {
+	*b = binary.AppendUvarint(*b, uint64(field)<<3|uint64(wire))
+}
+
+func (b *protoBuffer) varint(field int, v uint64) {
+	b.tag(field, 0)
+	*b = binary.AppendUvarint(*b, v)
+}
+
+func (b *protoBuffer) fixed64(field int, v uint64) {
+	b.tag(field, 1)
+	*b = binary.LittleEndian.AppendUint64(*b, v)
+}
+
+func (b *protoBuffer) bytes(field int, v []byte) {
+	b.tag(field, 2)
+	*b = binary.AppendUvarint(*b, uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *protoBuffer) string(field int, v string) {
+	b.bytes(field, []byte(v))
+}
+
+// message appends the message built by fn as field
+func (b *protoBuffer) message(field int, fn func(*protoBuffer)) {
+	var inner protoBuffer
+	fn(&inner)
+	b.bytes(field, inner)
+}
+
+// keyValue appends a KeyValue with a string value as field
+func (b *protoBuffer) keyValue(field int, key, value string) {
+	b.message(field, func(kv *protoBuffer) {
+		kv.string(1, key)
+		kv.message(2, func(av *protoBuffer) { av.string(1, value) })
+	})
+}
@@ -0,0 +1,349 @@
+package rrd2prom_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jessegalley/rrd2prom"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// protoMessage is a decoded protobuf message, field number to values.
+// Varints and fixed64s are kept as numbers, everything length-delimited
+// as bytes.
+type protoMessage map[int][]interface{}
+
+func decodeProto(t *testing.T, b []byte) protoMessage {
+	t.Helper()
+
+	msg := make(protoMessage)
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		require.Positive(t, n, "bad key")
+		b = b[n:]
+		field := int(key >> 3)
+
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			require.Positive(t, n, "bad varint")
+			msg[field] = append(msg[field], v)
+			b = b[n:]
+		case 1:
+			require.GreaterOrEqual(t, len(b), 8)
+			msg[field] = append(msg[field], binary.LittleEndian.Uint64(b))
+			b = b[8:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			require.Positive(t, n, "bad length")
+			b = b[n:]
+			require.GreaterOrEqual(t, uint64(len(b)), size)
+			msg[field] = append(msg[field], b[:size])
+			b = b[size:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+
+	return msg
+}
+
+// messages decodes every value of field as a message
+func (m protoMessage) messages(t *testing.T, field int) []protoMessage {
+	t.Helper()
+
+	var msgs []protoMessage
+	for _, v := range m[field] {
+		msgs = append(msgs, decodeProto(t, v.([]byte)))
+	}
+
+	return msgs
+}
+
+func (m protoMessage) string(field int) string {
+	if len(m[field]) == 0 {
+		return ""
+	}
+	return string(m[field][0].([]byte))
+}
+
+func (m protoMessage) uint(field int) uint64 {
+	if len(m[field]) == 0 {
+		return 0
+	}
+	return m[field][0].(uint64)
+}
+
+// attributes decodes the KeyValues in field as a map
+func (m protoMessage) attributes(t *testing.T, field int) map[string]string {
+	t.Helper()
+
+	attrs := make(map[string]string)
+	for _, kv := range m.messages(t, field) {
+		attrs[kv.string(1)] = kv.messages(t, 2)[0].string(1)
+	}
+
+	return attrs
+}
+
+// otlpReceiver is a stand-in OTLP/HTTP receiver that records every
+// request it accepts, failing the first failures ones with status
+type otlpReceiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	status   int
+	failures int
+	requests int
+	bodies   [][]byte
+	header   http.Header
+}
+
+func newOTLPReceiver(t *testing.T) *otlpReceiver {
+	t.Helper()
+
+	r := &otlpReceiver{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.requests++
+		r.header = req.Header
+		if r.failures > 0 {
+			r.failures--
+			w.WriteHeader(r.status)
+			return
+		}
+		r.bodies = append(r.bodies, body)
+	}))
+	t.Cleanup(r.Close)
+
+	return r
+}
+
+// resources returns the ResourceMetrics of every accepted request
+func (r *otlpReceiver) resources(t *testing.T) []protoMessage {
+	t.Helper()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var resources []protoMessage
+	for _, body := range r.bodies {
+		resources = append(resources, decodeProto(t, body).messages(t, 1)...)
+	}
+
+	return resources
+}
+
+// metricsOf returns the Metrics of a ResourceMetrics by name
+func metricsOf(t *testing.T, rm protoMessage) map[string]protoMessage {
+	t.Helper()
+
+	metrics := make(map[string]protoMessage)
+	for _, sm := range rm.messages(t, 2) {
+		for _, metric := range sm.messages(t, 2) {
+			metrics[metric.string(1)] = metric
+		}
+	}
+
+	return metrics
+}
+
+func newOTLPSink(t *testing.T, r *otlpReceiver, opts rrd2prom.OTLPOptions) *rrd2prom.OTLPSink {
+	t.Helper()
+
+	opts.Endpoint = r.URL + "/v1/metrics"
+	if opts.RetryBackoff == 0 {
+		opts.RetryBackoff = time.Millisecond
+	}
+	sink, err := rrd2prom.NewOTLPSink(opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { sink.Close() })
+
+	return sink
+}
+
+func TestOTLPSink(t *testing.T) {
+	receiver := newOTLPReceiver(t)
+	sink := newOTLPSink(t, receiver, rrd2prom.OTLPOptions{Headers: map[string]string{"Authorization": "Bearer x"}})
+
+	updated := time.Unix(1735589344, 0)
+	// env was added by relabeling, so it's left off the resource
+	fileLabels := map[string]string{"site": "ams"}
+	labels := map[string]string{"site": "ams", "env": "prod"}
+	require.NoError(t, sink.WriteMetrics("port1", []rrd2prom.Metric{
+		{Name: "rrd_traffic_in", File: "port1", Type: "COUNTER", Value: 42, Labels: fileLabels, FileLabels: fileLabels, LastUpdate: updated},
+		{Name: "rrd_temperature", File: "port1", Type: "GAUGE", Value: math.NaN(), Labels: labels, FileLabels: fileLabels, LastUpdate: updated},
+		{Name: "rrd_ds_info", File: "port1", Type: "GAUGE", Value: 1, Labels: map[string]string{"site": "ams", "ds": "a"}, FileLabels: fileLabels, LastUpdate: updated},
+		{Name: "rrd_ds_info", File: "port1", Type: "GAUGE", Value: 1, Labels: map[string]string{"site": "ams", "ds": "b"}, FileLabels: fileLabels, LastUpdate: updated},
+	}))
+	require.NoError(t, sink.Flush(context.Background()))
+
+	receiver.mu.Lock()
+	assert.Equal(t, "application/x-protobuf", receiver.header.Get("Content-Type"))
+	assert.Equal(t, "Bearer x", receiver.header.Get("Authorization"))
+	receiver.mu.Unlock()
+
+	resources := receiver.resources(t)
+	require.Len(t, resources, 1)
+	assert.Equal(t, map[string]string{"service.name": "rrd2prom", "file": "port1", "site": "ams"},
+		resources[0].messages(t, 1)[0].attributes(t, 1))
+	scope := resources[0].messages(t, 2)[0].messages(t, 1)[0]
+	assert.Equal(t, "rrd2prom", scope.string(1))
+
+	metrics := metricsOf(t, resources[0])
+	require.Len(t, metrics, 3)
+
+	// counters are cumulative monotonic sums
+	sum := metrics["rrd_traffic_in"].messages(t, 7)
+	require.Len(t, sum, 1)
+	assert.Equal(t, uint64(2), sum[0].uint(2))
+	assert.Equal(t, uint64(1), sum[0].uint(3))
+	point := sum[0].messages(t, 1)[0]
+	assert.Equal(t, uint64(updated.UnixNano()), point.uint(2))
+	assert.Equal(t, uint64(updated.UnixNano()), point.uint(3))
+	assert.Equal(t, 42.0, math.Float64frombits(point.uint(4)))
+	assert.Empty(t, point.attributes(t, 7))
+
+	// unknown values are flagged rather than sent
+	gauge := metrics["rrd_temperature"].messages(t, 5)
+	require.Len(t, gauge, 1)
+	point = gauge[0].messages(t, 1)[0]
+	assert.Empty(t, point[4])
+	assert.Equal(t, uint64(1), point.uint(8))
+	assert.Equal(t, map[string]string{"env": "prod"}, point.attributes(t, 7))
+
+	// so do labels the file doesn't have
+	points := metrics["rrd_ds_info"].messages(t, 5)[0].messages(t, 1)
+	require.Len(t, points, 2)
+	assert.Equal(t, map[string]string{"ds": "a"}, points[0].attributes(t, 7))
+	assert.Equal(t, map[string]string{"ds": "b"}, points[1].attributes(t, 7))
+}
+
+func TestOTLPSink_CounterReset(t *testing.T) {
+	receiver := newOTLPReceiver(t)
+	sink := newOTLPSink(t, receiver, rrd2prom.OTLPOptions{})
+
+	first := time.Unix(1735589344, 0)
+	for i, value := range []float64{100, 200, 50} {
+		require.NoError(t, sink.WriteMetrics("port1", []rrd2prom.Metric{
+			{Name: "rrd_traffic_in", File: "port1", Type: "COUNTER", Value: value, LastUpdate: first.Add(time.Duration(i) * time.Minute)},
+		}))
+	}
+	require.NoError(t, sink.Flush(context.Background()))
+
+	var starts []time.Time
+	for _, rm := range receiver.resources(t) {
+		point := metricsOf(t, rm)["rrd_traffic_in"].messages(t, 7)[0].messages(t, 1)[0]
+		starts = append(starts, time.Unix(0, int64(point.uint(2))))
+	}
+	assert.Equal(t, []time.Time{first, first, first.Add(time.Minute)}, starts)
+}
+
+func TestOTLPSink_Batching(t *testing.T) {
+	receiver := newOTLPReceiver(t)
+	sink := newOTLPSink(t, receiver, rrd2prom.OTLPOptions{BatchSize: 2, FlushInterval: time.Hour})
+
+	metric := rrd2prom.Metric{Name: "rrd_traffic_in", Type: "COUNTER", Value: 1}
+	require.NoError(t, sink.WriteMetrics("port1", []rrd2prom.Metric{metric}))
+	assert.Empty(t, receiver.resources(t))
+
+	// the second metric fills the batch
+	require.NoError(t, sink.WriteMetrics("port2", []rrd2prom.Metric{metric}))
+	assert.Len(t, receiver.resources(t), 2)
+
+	// what's left is sent on close
+	require.NoError(t, sink.WriteMetrics("port3", []rrd2prom.Metric{metric}))
+	require.NoError(t, sink.Close())
+	assert.Len(t, receiver.resources(t), 3)
+}
+
+func TestOTLPSink_FlushInterval(t *testing.T) {
+	receiver := newOTLPReceiver(t)
+	sink := newOTLPSink(t, receiver, rrd2prom.OTLPOptions{FlushInterval: 10 * time.Millisecond})
+
+	require.NoError(t, sink.WriteMetrics("port1", []rrd2prom.Metric{{Name: "rrd_traffic_in", Type: "COUNTER", Value: 1}}))
+	assert.Eventually(t, func() bool { return len(receiver.resources(t)) == 1 }, time.Second, 5*time.Millisecond)
+}
+
+func TestOTLPSink_Restart(t *testing.T) {
+	receiver := newOTLPReceiver(t)
+	sink := newOTLPSink(t, receiver, rrd2prom.OTLPOptions{FlushInterval: 10 * time.Millisecond})
+	metrics := []rrd2prom.Metric{{Name: "rrd_traffic_in", Type: "COUNTER", Value: 1}}
+
+	// a manager that's started again after shutting down carries on with
+	// the same sink, flushing in the background included
+	require.NoError(t, sink.WriteMetrics("port1", metrics))
+	require.NoError(t, sink.Close())
+	assert.Len(t, receiver.resources(t), 1)
+
+	require.NoError(t, sink.WriteMetrics("port1", metrics))
+	assert.Eventually(t, func() bool { return len(receiver.resources(t)) == 2 }, time.Second, 5*time.Millisecond)
+	require.NoError(t, sink.Close())
+}
+
+func TestOTLPSink_Retry(t *testing.T) {
+	receiver := newOTLPReceiver(t)
+	sink := newOTLPSink(t, receiver, rrd2prom.OTLPOptions{MaxRetries: 2})
+	metrics := []rrd2prom.Metric{{Name: "rrd_traffic_in", Type: "COUNTER", Value: 1}}
+
+	// unavailable is worth retrying
+	receiver.mu.Lock()
+	receiver.status, receiver.failures = http.StatusServiceUnavailable, 2
+	receiver.mu.Unlock()
+	require.NoError(t, sink.WriteMetrics("port1", metrics))
+	require.NoError(t, sink.Flush(context.Background()))
+	receiver.mu.Lock()
+	assert.Equal(t, 3, receiver.requests)
+	receiver.mu.Unlock()
+	assert.Len(t, receiver.resources(t), 1)
+
+	// but only so many times
+	receiver.mu.Lock()
+	receiver.requests, receiver.failures = 0, 3
+	receiver.mu.Unlock()
+	require.NoError(t, sink.WriteMetrics("port1", metrics))
+	assert.Error(t, sink.Flush(context.Background()))
+
+	// a bad request never is
+	receiver.mu.Lock()
+	receiver.requests, receiver.status, receiver.failures = 0, http.StatusBadRequest, 1
+	receiver.mu.Unlock()
+	require.NoError(t, sink.WriteMetrics("port1", metrics))
+	assert.Error(t, sink.Flush(context.Background()))
+	receiver.mu.Lock()
+	assert.Equal(t, 1, receiver.requests)
+	receiver.mu.Unlock()
+}
+
+func TestRRDManager_OTLPSink(t *testing.T) {
+	fakes := newFakeRRDs(t)
+	receiver := newOTLPReceiver(t)
+	sink := newOTLPSink(t, receiver, rrd2prom.OTLPOptions{})
+
+	m, err := rrd2prom.NewRRDManager(
+		[]*rrd2prom.RRDFile{newFastFile(t, fakes, "port1")},
+		rrd2prom.WithSink(sink, rrd2prom.SinkOptions{Name: "otlp", Policy: rrd2prom.SinkBlock}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, m.CollectOnce(context.Background()))
+
+	// the sink is closed along with the others, which flushes it
+	resources := receiver.resources(t)
+	require.Len(t, resources, 1)
+	sum := metricsOf(t, resources[0])["rrd_traffic_in"].messages(t, 7)
+	require.Len(t, sum, 1)
+	point := sum[0].messages(t, 1)[0]
+	assert.Equal(t, uint64(time.Unix(1735589344, 0).UnixNano()), point.uint(3))
+	assert.Equal(t, 42.0, math.Float64frombits(point.uint(4)))
+}
@@ -0,0 +1,115 @@
+package rrd2prom
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Pusher sends the metrics in a Store to a Prometheus Pushgateway, for
+// runs that are too short to be scraped.
+type Pusher struct {
+	// URL is the Pushgateway's base URL, like http://pushgateway:9091
+	URL string
+	// Job and Grouping make up the group the metrics are pushed to, each
+	// push replaces everything previously pushed to the same group
+	Job      string
+	Grouping map[string]string
+	// Client is used for the push, defaults to http.DefaultClient
+	Client *http.Client
+	// UTF8 pushes names that aren't valid classic Prometheus names as
+	// they are, which the Pushgateway only takes when it's started with
+	// --push.enable-utf8-names. Otherwise their odd characters are
+	// replaced with _
+	UTF8 bool
+}
+
+// Push replaces the metrics of the pusher's group with everything in
+// store.
+func (p *Pusher) Push(ctx context.Context, store *Store) error {
+	if p.Job == "" {
+		return fmt.Errorf("couldn't push: no job")
+	}
+	target, err := p.groupURL()
+	if err != nil {
+		return fmt.Errorf("couldn't push: %w", err)
+	}
+
+	var body bytes.Buffer
+	if err := store.writeText(&body, p.UTF8); err != nil {
+		return fmt.Errorf("couldn't push: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, &body)
+	if err != nil {
+		return fmt.Errorf("couldn't push to %s: %w", target, err)
+	}
+	req.Header.Set("Content-Type", TextContentType(p.UTF8))
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("couldn't push to %s: %w", target, err)
+	}
+	defer resp.Body.Close()
+
+	// the Pushgateway answers 200 or 202 depending on its version
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("couldn't push to %s: bad status: %s: %s", target, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
+
+// groupURL builds the URL of the pusher's group:
+// <URL>/metrics/job/<job>{/<label>/<value>}
+func (p *Pusher) groupURL() (string, error) {
+	base, err := url.Parse(p.URL)
+	if err != nil {
+		return "", err
+	}
+	if base.Scheme == "" || base.Host == "" {
+		return "", fmt.Errorf("invalid push URL %q", p.URL)
+	}
+
+	names := make([]string, 0, len(p.Grouping))
+	for name := range p.Grouping {
+		if err := checkLabelName(name); err != nil || name == "job" {
+			return "", fmt.Errorf("invalid grouping label %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	path := strings.TrimSuffix(base.String(), "/") + "/metrics/job" + pushSegment(p.Job)
+	for _, name := range names {
+		path += "/" + name + pushSegment(p.Grouping[name])
+	}
+
+	return path, nil
+}
+
+// pushSegment encodes a job or label value as a path segment. Values the
+// path can't hold as they are, like ones with a slash, are base64
+// encoded the way the Pushgateway expects, with = standing in for an
+// empty value.
+func pushSegment(value string) string {
+	if value == "" {
+		return "@base64/="
+	}
+	if strings.Contains(value, "/") {
+		return "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+
+	return "/" + url.PathEscape(value)
+}
@@ -0,0 +1,139 @@
+package rrd2prom_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/jessegalley/rrd2prom"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pushGateway is a stand-in Pushgateway that records every push
+type pushGateway struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	status      int
+	method      string
+	path        string
+	contentType string
+	body        string
+}
+
+func newPushGateway(t *testing.T) *pushGateway {
+	t.Helper()
+
+	g := &pushGateway{status: http.StatusOK}
+	g.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.method, g.path, g.body = r.Method, r.URL.EscapedPath(), string(body)
+		g.contentType = r.Header.Get("Content-Type")
+		w.WriteHeader(g.status)
+	}))
+	t.Cleanup(g.Close)
+
+	return g
+}
+
+func TestPusher(t *testing.T) {
+	gateway := newPushGateway(t)
+
+	store := rrd2prom.NewStore()
+	require.NoError(t, store.WriteMetrics("port1", []rrd2prom.Metric{
+		{Name: "rrd_traffic_in", File: "port1", Source: "traffic_in", Value: 1},
+	}))
+
+	pusher := &rrd2prom.Pusher{
+		URL:      gateway.URL + "/",
+		Job:      "rrd cron",
+		Grouping: map[string]string{"instance": "nms1", "path": "/var/lib/rrd", "empty": ""},
+	}
+	require.NoError(t, pusher.Push(context.Background(), store))
+
+	gateway.mu.Lock()
+	assert.Equal(t, http.MethodPut, gateway.method)
+	assert.Equal(t, "/metrics/job/rrd%20cron/empty@base64/=/instance/nms1/path@base64/L3Zhci9saWIvcnJk", gateway.path)
+	assert.Equal(t, "rrd_traffic_in{file=\"port1\"} 1\n", gateway.body)
+	gateway.status = http.StatusBadRequest
+	gateway.mu.Unlock()
+
+	assert.Error(t, pusher.Push(context.Background(), store))
+
+	// bad groups are caught before anything is sent
+	for _, bad := range []*rrd2prom.Pusher{
+		{URL: gateway.URL},
+		{URL: "not a url", Job: "rrd"},
+		{URL: gateway.URL, Job: "rrd", Grouping: map[string]string{"job": "other"}},
+		{URL: gateway.URL, Job: "rrd", Grouping: map[string]string{"1bad": "x"}},
+	} {
+		assert.Error(t, bad.Push(context.Background(), store))
+	}
+}
+
+func TestPusher_UTF8(t *testing.T) {
+	gateway := newPushGateway(t)
+
+	store := rrd2prom.NewStore()
+	require.NoError(t, store.WriteMetrics("port1", []rrd2prom.Metric{
+		{Name: "rrd.traffic_in", File: "port1", Source: "traffic_in", Value: 1},
+	}))
+
+	// names are escaped unless the Pushgateway takes UTF-8 ones
+	pusher := &rrd2prom.Pusher{URL: gateway.URL, Job: "rrd"}
+	require.NoError(t, pusher.Push(context.Background(), store))
+	gateway.mu.Lock()
+	assert.Equal(t, "rrd_traffic_in{file=\"port1\"} 1\n", gateway.body)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", gateway.contentType)
+	gateway.mu.Unlock()
+
+	pusher.UTF8 = true
+	require.NoError(t, pusher.Push(context.Background(), store))
+	gateway.mu.Lock()
+	assert.Equal(t, "{\"rrd.traffic_in\",file=\"port1\"} 1\n", gateway.body)
+	assert.Contains(t, gateway.contentType, "escaping=allow-utf-8")
+	gateway.mu.Unlock()
+}
+
+func TestRRDManager_CollectOnce(t *testing.T) {
+	fakes := newFakeRRDs(t)
+	events := newEventRecorder()
+	store := rrd2prom.NewStore()
+
+	m, err := rrd2prom.NewRRDManager(
+		[]*rrd2prom.RRDFile{newFastFile(t, fakes, "port1"), newFastFile(t, fakes, "port2")},
+		events.option(),
+		rrd2prom.WithSink(store, rrd2prom.SinkOptions{Name: "store", Policy: rrd2prom.SinkBlock}),
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, m.CollectOnce(context.Background()))
+	assert.Len(t, store.Metrics(), 2)
+	events.waitFor(t, rrd2prom.EventUpdateOK)
+	events.waitFor(t, rrd2prom.EventUpdateOK)
+
+	// a source that fails is reported, the others still come through
+	fakes.mu.Lock()
+	delete(fakes.infos, "port2.rrd")
+	fakes.mu.Unlock()
+	require.NoError(t, store.WriteMetrics("port1", nil))
+	require.NoError(t, store.WriteMetrics("port2", nil))
+
+	err = m.CollectOnce(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "source port2")
+	assert.NotContains(t, err.Error(), "port1")
+	assert.Len(t, store.Metrics(), 1)
+
+	// it can't be used while the manager is running
+	require.NoError(t, m.Start(context.Background()))
+	assert.ErrorIs(t, m.CollectOnce(context.Background()), rrd2prom.ErrRunning)
+	require.NoError(t, m.Shutdown(context.Background()))
+}
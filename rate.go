@@ -0,0 +1,201 @@
+package rrd2prom
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateMode decides whether the manager turns counters into per-second
+// rates, for consumers that can't work out rates themselves.
+type RateMode int
+
+const (
+	// RatesOff exports raw values only, the default
+	RatesOff RateMode = iota
+	// RatesAlongside exports a rate next to the raw value of every
+	// COUNTER, DERIVE and ABSOLUTE data source
+	RatesAlongside
+	// RatesOnly replaces the raw values of those data sources with rates
+	RatesOnly
+)
+
+// ParseRateMode parses "off", "alongside" or "only" into a RateMode.
+func ParseRateMode(s string) (RateMode, error) {
+	switch s {
+	case "off", "":
+		return RatesOff, nil
+	case "alongside":
+		return RatesAlongside, nil
+	case "only":
+		return RatesOnly, nil
+	default:
+		return RatesOff, fmt.Errorf("invalid rate mode %q", s)
+	}
+}
+
+// rateUnit is appended to the unit of a rate
+const rateUnit = "per_second"
+
+// WithRates has the manager compute per-second rates of counters from
+// successive reads. Rates are worked out from the raw values the way
+// rrdtool does: COUNTERs wrap at 32 or 64 bits, DERIVEs can go down,
+// ABSOLUTEs are reset on every write, and rates outside the data
+// source's min and max are NaN. A COUNTER that went down by more than
+// half its range is taken to have restarted from zero. A data source's
+// transform multiplies the rate too, and the rate is named with the
+// transform's unit followed by _per_second. A name template that doesn't
+// use .Unit would give a rate the same name as its raw value, so
+// _per_second is appended to what it makes instead. The first read of a
+// file has nothing to compare to, so its rates only show up from the
+// second one.
+func WithRates(mode RateMode) Option {
+	return func(m *RRDManager) {
+		m.rateMode = mode
+	}
+}
+
+// hasRate reports whether a data source type gets a rate
+func hasRate(dsType string) bool {
+	switch dsType {
+	case "COUNTER", "DERIVE", "ABSOLUTE":
+		return true
+	default:
+		return false
+	}
+}
+
+// rateSample is the previous read of a data source, along with the rate
+// computed at it
+type rateSample struct {
+	value float64
+	at    time.Time
+	rate  float64
+	known bool // whether rate has been computed yet
+}
+
+// rateTracker remembers the previous read of every counter so rates can
+// be computed. It's keyed by file name, then data source name.
+type rateTracker struct {
+	mu    sync.Mutex
+	files map[string]map[string]rateSample
+}
+
+// expand adds the rates of the counters in values, read from file at
+// lastUpdate, dropping their raw values if mode is RatesOnly.
+func (t *rateTracker) expand(mode RateMode, file string, lastUpdate time.Time, values []dsValue) []dsValue {
+	if mode == RatesOff {
+		return values
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.files == nil {
+		t.files = make(map[string]map[string]rateSample)
+	}
+	prev := t.files[file]
+	next := make(map[string]rateSample, len(prev))
+	t.files[file] = next
+
+	expanded := make([]dsValue, 0, 2*len(values))
+	for _, v := range values {
+		if !hasRate(v.ds.Type) {
+			expanded = append(expanded, v)
+			continue
+		}
+		if mode == RatesAlongside {
+			expanded = append(expanded, v)
+		}
+
+		sample := rateStep(v.ds, prev[v.ds.Name], lastUpdate)
+		next[v.ds.Name] = sample
+		if !sample.known {
+			continue
+		}
+
+		unit := rateUnit
+		if v.unit != "" {
+			unit = v.unit + "_" + rateUnit
+		}
+		// a rate goes up and down, so it's a gauge whatever it came from
+		rateDS := v.ds
+		rateDS.Type = "GAUGE"
+		expanded = append(expanded, dsValue{ds: rateDS, value: sample.rate * v.scale, raw: sample.rate, unit: unit, scale: v.scale, rate: true})
+	}
+
+	return expanded
+}
+
+// release forgets every counter of file
+func (t *rateTracker) release(file string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.files, file)
+}
+
+// rateStep works out the rate of ds since prev, which is the zero sample
+// on the first read.
+func rateStep(ds RRDDataSource, prev rateSample, lastUpdate time.Time) rateSample {
+	cur := rateSample{value: ds.LastValue, at: lastUpdate}
+
+	// nothing new was written, keep the rate we had
+	if prev.at.Equal(lastUpdate) {
+		return prev
+	}
+	// an unknown value breaks the sequence, start again from the next
+	if math.IsNaN(ds.LastValue) {
+		cur.rate, cur.known = math.NaN(), true
+		cur.at = time.Time{}
+		return cur
+	}
+	if prev.at.IsZero() || math.IsNaN(prev.value) {
+		return cur
+	}
+
+	secs := lastUpdate.Sub(prev.at).Seconds()
+	if secs <= 0 {
+		return cur
+	}
+
+	var delta float64
+	switch ds.Type {
+	case "COUNTER":
+		delta = counterDelta(prev.value, cur.value)
+	case "DERIVE":
+		delta = cur.value - prev.value
+	case "ABSOLUTE":
+		delta = cur.value
+	}
+
+	cur.rate, cur.known = delta/secs, true
+	if cur.rate < ds.Min || cur.rate > ds.Max {
+		cur.rate = math.NaN()
+	}
+
+	return cur
+}
+
+// counterDelta is how much a COUNTER went up from prev to cur, allowing
+// for it wrapping at 32 or 64 bits like rrdtool does, or restarting
+func counterDelta(prev, cur float64) float64 {
+	if cur >= prev {
+		return cur - prev
+	}
+
+	// a counter that still fits in 32 bits most likely wrapped there
+	width := math.Exp2(64)
+	if prev < math.Exp2(32) {
+		width = math.Exp2(32)
+	}
+	delta := width - prev + cur
+	if delta > width/2 {
+		// wrapping would have taken more than half the counter's range,
+		// it's far more likely it was reset
+		return cur
+	}
+
+	return delta
+}
@@ -0,0 +1,73 @@
+package rrd2prom
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateStep(t *testing.T) {
+	base := time.Unix(1735589340, 0)
+	nan := math.NaN()
+
+	tests := []struct {
+		name     string
+		dsType   string
+		min, max float64
+		prev     float64
+		cur      float64
+		want     float64
+	}{
+		{"Counter", "COUNTER", nan, nan, 1000, 1600, 10},
+		{"Counter32Wrap", "COUNTER", nan, nan, math.Exp2(32) - 100, 500, 10},
+		{"Counter64Wrap", "COUNTER", nan, nan, math.Exp2(64) - 4096, 3104, 120},
+		{"CounterReset", "COUNTER", nan, nan, 1e9, 1200, 20},
+		{"CounterAboveMax", "COUNTER", 0, 5, 1000, 1600, nan},
+		{"Derive", "DERIVE", nan, nan, 1600, 1000, -10},
+		{"DeriveBelowMin", "DERIVE", 0, nan, 1600, 1000, nan},
+		{"Absolute", "ABSOLUTE", nan, nan, 5000, 300, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := RRDDataSource{Name: "ds", Type: tt.dsType, Min: tt.min, Max: tt.max}
+
+			ds.LastValue = tt.prev
+			first := rateStep(ds, rateSample{}, base)
+			assert.False(t, first.known)
+
+			ds.LastValue = tt.cur
+			second := rateStep(ds, first, base.Add(time.Minute))
+			assert.True(t, second.known)
+			if math.IsNaN(tt.want) {
+				assert.True(t, math.IsNaN(second.rate), "got %v", second.rate)
+			} else {
+				assert.InDelta(t, tt.want, second.rate, 1e-9)
+			}
+
+			// reading the file again before it's written keeps the rate
+			again := rateStep(ds, second, base.Add(time.Minute))
+			assert.Equal(t, second.known, again.known)
+			assert.Equal(t, second.at, again.at)
+		})
+	}
+}
+
+func TestRateStep_Unknown(t *testing.T) {
+	base := time.Unix(1735589340, 0)
+	ds := RRDDataSource{Name: "ds", Type: "COUNTER", LastValue: 100, Min: math.NaN(), Max: math.NaN()}
+
+	sample := rateStep(ds, rateSample{}, base)
+
+	// an unknown value has an unknown rate, and the next one starts over
+	ds.LastValue = math.NaN()
+	sample = rateStep(ds, sample, base.Add(time.Minute))
+	assert.True(t, sample.known)
+	assert.True(t, math.IsNaN(sample.rate))
+
+	ds.LastValue = 700
+	sample = rateStep(ds, sample, base.Add(2*time.Minute))
+	assert.False(t, sample.known)
+}
@@ -0,0 +1,71 @@
+package rrd2prom_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/jessegalley/rrd2prom"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRateMode(t *testing.T) {
+	for s, want := range map[string]rrd2prom.RateMode{
+		"":          rrd2prom.RatesOff,
+		"off":       rrd2prom.RatesOff,
+		"alongside": rrd2prom.RatesAlongside,
+		"only":      rrd2prom.RatesOnly,
+	} {
+		mode, err := rrd2prom.ParseRateMode(s)
+		require.NoError(t, err)
+		assert.Equal(t, want, mode, s)
+	}
+
+	_, err := rrd2prom.ParseRateMode("sometimes")
+	assert.Error(t, err)
+}
+
+func TestRRDManager_Rates(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     rrd2prom.RateMode
+		template string
+		want     string
+	}{
+		{"Alongside", rrd2prom.RatesAlongside, "", "rrd_traffic_in{file=\"port1\"} 1600\nrrd_traffic_in_per_second{file=\"port1\"} 10\n"},
+		{"Only", rrd2prom.RatesOnly, "", "rrd_traffic_in_per_second{file=\"port1\"} 10\n"},
+		// a template without .Unit still keeps the rate apart
+		{"NoUnit", rrd2prom.RatesAlongside, "{{.Prefix}}_{{.DS}}", "rrd_traffic_in{file=\"port1\"} 1600\nrrd_traffic_in_per_second{file=\"port1\"} 10\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakes := newFakeRRDs(t)
+			events := newEventRecorder()
+			store := rrd2prom.NewStore()
+			namer, err := rrd2prom.NewNamer(rrd2prom.NamingOptions{Template: tt.template})
+			require.NoError(t, err)
+
+			m, sink := newManager(t, []*rrd2prom.RRDFile{newFastFile(t, fakes, "port1")},
+				events.option(),
+				rrd2prom.WithNamer(namer),
+				rrd2prom.WithRates(tt.mode),
+				rrd2prom.WithSink(store, rrd2prom.SinkOptions{Name: "store"}),
+			)
+
+			// the first read has nothing to compute a rate from
+			fakes.set("port1.rrd", 1735589340, 1000)
+			startManager(t, m, sink)
+			events.waitFor(t, rrd2prom.EventUpdateOK)
+
+			// a minute later the counter has gone up by 600
+			fakes.set("port1.rrd", 1735589400, 1600)
+			assert.Eventually(t, func() bool {
+				var buf bytes.Buffer
+				require.NoError(t, store.WriteText(&buf))
+				return buf.String() == tt.want
+			}, 2*time.Second, 5*time.Millisecond)
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package rrd2prom
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// meta labels available to relabel rules on top of a metric's own labels.
+// __name__ is the metric name and can be changed, the others are dropped
+// once relabeling is done, like any other label starting with __
+const (
+	labelMetricName = "__name__"
+	labelDS         = "__ds__"
+	labelDSType     = "__type__"
+)
+
+// RelabelAction is what a relabel rule does with a metric.
+type RelabelAction string
+
+// relabel actions, they behave like the Prometheus ones of the same name
+const (
+	RelabelReplace   RelabelAction = "replace"
+	RelabelKeep      RelabelAction = "keep"
+	RelabelDrop      RelabelAction = "drop"
+	RelabelHashMod   RelabelAction = "hashmod"
+	RelabelLabelMap  RelabelAction = "labelmap"
+	RelabelLabelDrop RelabelAction = "labeldrop"
+	RelabelLabelKeep RelabelAction = "labelkeep"
+)
+
+// RelabelConfig is a single rule of metric_relabel_configs. It works like
+// its Prometheus counterpart: the values of SourceLabels are joined with
+// Separator and matched against Regex, then Action decides what happens.
+// Besides the metric's labels, rules can use __name__ (the metric name),
+// __ds__ (the data source's name) and __type__ (its type, like COUNTER).
+type RelabelConfig struct {
+	SourceLabels []string      `yaml:"source_labels"`
+	Separator    *string       `yaml:"separator"`
+	Regex        *string       `yaml:"regex"`
+	Modulus      uint64        `yaml:"modulus"`
+	TargetLabel  string        `yaml:"target_label"`
+	Replacement  *string       `yaml:"replacement"`
+	Action       RelabelAction `yaml:"action"`
+}
+
+// relabel defaults, same as Prometheus
+const (
+	defaultRelabelSeparator   = ";"
+	defaultRelabelRegex       = "(.*)"
+	defaultRelabelReplacement = "$1"
+)
+
+// relabelRule is a RelabelConfig with its defaults filled in and its
+// regex compiled
+type relabelRule struct {
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp
+	modulus      uint64
+	targetLabel  string
+	replacement  string
+	action       RelabelAction
+}
+
+// Relabeler applies a list of relabel rules to metrics, in order.
+type Relabeler struct {
+	rules []relabelRule
+}
+
+// NewRelabeler compiles configs into a Relabeler, checking each rule has
+// what its action needs.
+func NewRelabeler(configs []RelabelConfig) (*Relabeler, error) {
+	r := &Relabeler{rules: make([]relabelRule, 0, len(configs))}
+	for i, cfg := range configs {
+		rule, err := newRelabelRule(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("relabel rule %d: %w", i, err)
+		}
+		r.rules = append(r.rules, rule)
+	}
+
+	return r, nil
+}
+
+// newRelabelRule fills in the defaults for cfg and checks it
+func newRelabelRule(cfg RelabelConfig) (relabelRule, error) {
+	rule := relabelRule{
+		sourceLabels: cfg.SourceLabels,
+		separator:    defaultRelabelSeparator,
+		modulus:      cfg.Modulus,
+		targetLabel:  cfg.TargetLabel,
+		replacement:  defaultRelabelReplacement,
+		action:       cfg.Action,
+	}
+	if cfg.Separator != nil {
+		rule.separator = *cfg.Separator
+	}
+	if cfg.Replacement != nil {
+		rule.replacement = *cfg.Replacement
+	}
+	if rule.action == "" {
+		rule.action = RelabelReplace
+	}
+
+	pattern := defaultRelabelRegex
+	if cfg.Regex != nil {
+		pattern = *cfg.Regex
+	}
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return rule, fmt.Errorf("invalid regex %q: %w", pattern, err)
+	}
+	rule.regex = re
+
+	switch rule.action {
+	case RelabelReplace:
+		if rule.targetLabel == "" {
+			return rule, fmt.Errorf("%s needs a target_label", rule.action)
+		}
+		// a target with references is only known once it's expanded
+		if !strings.Contains(rule.targetLabel, "$") && !labelNameRE.MatchString(rule.targetLabel) {
+			return rule, fmt.Errorf("invalid target_label %q", rule.targetLabel)
+		}
+	case RelabelHashMod:
+		if rule.targetLabel == "" {
+			return rule, fmt.Errorf("%s needs a target_label", rule.action)
+		}
+		if !labelNameRE.MatchString(rule.targetLabel) {
+			return rule, fmt.Errorf("invalid target_label %q", rule.targetLabel)
+		}
+		if rule.modulus == 0 {
+			return rule, fmt.Errorf("%s needs a modulus", rule.action)
+		}
+	case RelabelKeep, RelabelDrop:
+		if len(rule.sourceLabels) == 0 {
+			return rule, fmt.Errorf("%s needs source_labels", rule.action)
+		}
+	case RelabelLabelMap, RelabelLabelDrop, RelabelLabelKeep:
+	default:
+		return rule, fmt.Errorf("unknown action %q", rule.action)
+	}
+
+	return rule, nil
+}
+
+// process runs every rule over labels, changing them in place. It
+// returns false if a rule dropped the metric.
+func (r *Relabeler) process(labels map[string]string) bool {
+	for _, rule := range r.rules {
+		if !rule.apply(labels) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// apply runs a single rule over labels, returning false if the metric
+// should be dropped
+func (rule relabelRule) apply(labels map[string]string) bool {
+	values := make([]string, len(rule.sourceLabels))
+	for i, name := range rule.sourceLabels {
+		values[i] = labels[name]
+	}
+	value := strings.Join(values, rule.separator)
+
+	switch rule.action {
+	case RelabelKeep:
+		return rule.regex.MatchString(value)
+	case RelabelDrop:
+		return !rule.regex.MatchString(value)
+	case RelabelReplace:
+		match := rule.regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			break
+		}
+		target := string(rule.regex.ExpandString(nil, rule.targetLabel, value, match))
+		if !labelNameRE.MatchString(target) {
+			break
+		}
+		replaced := string(rule.regex.ExpandString(nil, rule.replacement, value, match))
+		if replaced == "" {
+			delete(labels, target)
+		} else {
+			labels[target] = replaced
+		}
+	case RelabelHashMod:
+		sum := md5.Sum([]byte(value))
+		labels[rule.targetLabel] = fmt.Sprint(binary.BigEndian.Uint64(sum[8:]) % rule.modulus)
+	case RelabelLabelMap:
+		// collect first so mapped labels aren't matched again
+		mapped := make(map[string]string)
+		for name, v := range labels {
+			if rule.regex.MatchString(name) {
+				target := rule.regex.ReplaceAllString(name, rule.replacement)
+				if labelNameRE.MatchString(target) {
+					mapped[target] = v
+				}
+			}
+		}
+		for name, v := range mapped {
+			labels[name] = v
+		}
+	case RelabelLabelDrop, RelabelLabelKeep:
+		drop := rule.action == RelabelLabelDrop
+		for name := range labels {
+			// the metric name isn't a label, so it's never dropped
+			if name != labelMetricName && rule.regex.MatchString(name) == drop {
+				delete(labels, name)
+			}
+		}
+	}
+
+	return true
+}
+
+// relabel runs metric through r, returning the rewritten metric and false
+// if it was dropped. The metric's labels are copied, never modified.
+func (r *Relabeler) relabel(metric Metric, dsType string) (Metric, bool) {
+	labels := make(map[string]string, len(metric.Labels)+4)
+	for name, value := range metric.Labels {
+		labels[name] = value
+	}
+	labels["file"] = metric.File
+	labels[labelMetricName] = metric.Name
+	labels[labelDS] = metric.Source
+	labels[labelDSType] = dsType
+
+	if !r.process(labels) || labels[labelMetricName] == "" {
+		return metric, false
+	}
+
+	metric.Name = labels[labelMetricName]
+	metric.File = labels["file"]
+	metric.Labels = make(map[string]string, len(labels))
+	for name, value := range labels {
+		// like Prometheus, an empty label is the same as no label
+		if name != "file" && !strings.HasPrefix(name, "__") && value != "" {
+			metric.Labels[name] = value
+		}
+	}
+
+	return metric, true
+}
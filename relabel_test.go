@@ -0,0 +1,92 @@
+package rrd2prom_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/jessegalley/rrd2prom"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRelabeler(t *testing.T) {
+	str := func(s string) *string { return &s }
+
+	tests := []struct {
+		name    string
+		config  rrd2prom.RelabelConfig
+		wantErr bool
+	}{
+		{"DefaultReplace", rrd2prom.RelabelConfig{SourceLabels: []string{"__ds__"}, TargetLabel: "ds"}, false},
+		{"ReplaceWithoutTarget", rrd2prom.RelabelConfig{SourceLabels: []string{"__ds__"}}, true},
+		{"ReplaceBadTarget", rrd2prom.RelabelConfig{TargetLabel: "1ds"}, true},
+		{"ReplaceExpandedTarget", rrd2prom.RelabelConfig{Regex: str("(.*)"), TargetLabel: "${1}_ds"}, false},
+		{"BadRegex", rrd2prom.RelabelConfig{Regex: str("(traffic"), TargetLabel: "ds"}, true},
+		{"KeepWithoutSource", rrd2prom.RelabelConfig{Action: rrd2prom.RelabelKeep}, true},
+		{"HashModWithoutModulus", rrd2prom.RelabelConfig{Action: rrd2prom.RelabelHashMod, TargetLabel: "shard"}, true},
+		{"LabelDrop", rrd2prom.RelabelConfig{Action: rrd2prom.RelabelLabelDrop, Regex: str("site")}, false},
+		{"UnknownAction", rrd2prom.RelabelConfig{Action: "mangle"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := rrd2prom.NewRelabeler([]rrd2prom.RelabelConfig{tt.config})
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestRRDManager_Relabel(t *testing.T) {
+	fakes := newFakeRRDs(t)
+	fakes.set("core1.rrd", 1735589344, 1)
+	fakes.mu.Lock()
+	fakes.infos["core1.rrd"]["ds.index"] = map[string]interface{}{"traffic_in": uint(0), "traffic_out": uint(1), "unused": uint(2)}
+	fakes.infos["core1.rrd"]["ds.type"] = map[string]interface{}{"traffic_in": "COUNTER", "traffic_out": "COUNTER", "unused": "GAUGE"}
+	fakes.infos["core1.rrd"]["ds.last_ds"] = map[string]interface{}{"traffic_in": "1", "traffic_out": "2", "unused": "3"}
+	fakes.mu.Unlock()
+
+	store := rrd2prom.NewStore()
+	m, sink := newManager(t, nil, rrd2prom.WithSink(store, rrd2prom.SinkOptions{Name: "store"}))
+	startManager(t, m, sink)
+
+	// fold traffic_in and traffic_out into one family, drop the unused
+	// data source and shard by file
+	require.NoError(t, m.ApplyConfig(writeConfig(t, `
+interval: 10ms
+labels:
+  site: ams
+metric_relabel_configs:
+ - source_labels: [__ds__]
+   regex: unused
+   action: drop
+ - source_labels: [__ds__]
+   regex: traffic_(in|out)
+   target_label: direction
+ - source_labels: [__type__]
+   regex: COUNTER
+   target_label: __name__
+   replacement: interface_octets_total
+sources:
+ - location: core1.rrd
+   metric_relabel_configs:
+    - source_labels: [file]
+      target_label: shard
+      modulus: 4
+      action: hashmod
+    - regex: site
+      action: labeldrop
+`)))
+
+	assert.Eventually(t, func() bool { return len(store.Metrics()) == 2 }, 2*time.Second, 5*time.Millisecond)
+
+	var buf bytes.Buffer
+	require.NoError(t, store.WriteText(&buf))
+	assert.Equal(t, `interface_octets_total{direction="in",file="core1",shard="3"} 1
+interface_octets_total{direction="out",file="core1",shard="3"} 2
+`, buf.String())
+}
@@ -1,12 +1,19 @@
 package rrd2prom
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
   "crypto/tls"
 
@@ -14,21 +21,100 @@ import (
 	"github.com/ziutek/rrd"
 )
 
+// RRDFile is an RRD file along with the latest values read from it.
+// LastUpdate and DataSources are replaced wholesale by Update, and
+// Interval and Step change along with the file's step, so readers
+// running alongside Update should go through Snapshot rather than
+// touching the fields directly.
 type RRDFile struct {
   Location     string
   Name         string 
   Interval     time.Duration 
+  Step         time.Duration
   LastUpdate   time.Time 
   DataSources  map[string]RRDDataSource
+
+  // Version is the file format version, like "0003", and RRAs the
+  // archives the file keeps. both are empty if librrd didn't report them
+  Version      string
+  RRAs         []RRA
+
+  // Timeout limits how long a single read can take when the file is
+  // collected by a manager, zero for no limit
+  Timeout      time.Duration
+
+  // Labels are added to every metric from the file. Set them before
+  // handing the file to a manager, they mustn't change after that
+  Labels       map[string]string
+
+  // Relabel rewrites or drops every metric from the file before it's
+  // sent on, nil to leave them alone. Like Labels, set it before Add
+  Relabel      *Relabeler
+
+  // Transform changes the values of data sources before they're sent
+  // on, and can add new ones computed from the others. nil to leave
+  // them alone, like Labels it's set before Add
+  Transform    *Transformer
+
+  // filter picks the data sources that are read, it's set when the
+  // file is created and never changes
+  filter       *DSFilter
+
+  // mu guards Interval, Step, LastUpdate, DataSources, Version and
+  // RRAs. the DataSources map and RRAs slice are never modified once
+  // published, Update swaps in fresh ones instead, so snapshots can
+  // share them without copying
+  mu           sync.RWMutex
+
+  // schemaChange is what the last Update found had changed, guarded
+  // by mu
+  schemaChange *SchemaChange
+
+  // bytesFetched counts everything downloaded for HTTP locations
+  bytesFetched atomic.Uint64
+}
+
+// RRDSnapshot is a consistent view of an RRDFile at a single point in
+// time. DataSources and RRAs are shared with other snapshots and must
+// not be modified.
+type RRDSnapshot struct {
+  Name         string
+  Location     string
+  Interval     time.Duration
+  Step         time.Duration
+  LastUpdate   time.Time
+  DataSources  map[string]RRDDataSource
+  Labels       map[string]string
+  Version      string
+  RRAs         []RRA
 }
 
 type RRDDataSource struct {
   Name       string 
   Type       string
   Index      uint
-  LastValue  uint64
+  // LastValue is NaN when rrdtool reports it as unknown ("U")
+  LastValue  float64
+  // Min and Max are the data source's allowed range, NaN when unset
+  Min        float64
+  Max        float64
+  // Heartbeat is the longest gap between writes before the value
+  // becomes unknown, zero if librrd didn't report it
+  Heartbeat  time.Duration
 }
 
+// RRA is one of the round robin archives of an RRD file.
+type RRA struct {
+  CF         string
+  PDPPerRow  uint
+  Rows       uint
+  XFF        float64
+}
+
+
+// rrdInfo is the function used to read RRD metadata. it's a variable
+// so tests can swap in canned info maps without needing real RRDs.
+var rrdInfo = rrd.Info
 
 func init(){
   spew.Dump(nil) //lol 
@@ -40,13 +126,27 @@ func init(){
 // Will return an error if the file is inacessible for any reason 
 // at either method.
 func NewRRDFile (fileLocation, name string) (*RRDFile, error) {
+  return NewRRDFileContext(context.Background(), fileLocation, name)
+}
+
+// NewRRDFileContext is NewRRDFile, giving up on the first read once
+// ctx is done.
+func NewRRDFileContext (ctx context.Context, fileLocation, name string) (*RRDFile, error) {
+  return NewFilteredRRDFile(ctx, fileLocation, name, nil)
+}
+
+// NewFilteredRRDFile is NewRRDFileContext, only reading the data sources
+// that filter matches, both now and on every Update. A nil filter reads
+// them all.
+func NewFilteredRRDFile (ctx context.Context, fileLocation, name string, filter *DSFilter) (*RRDFile, error) {
   rrdFile := RRDFile{
     Location: fileLocation,
     Name: name,
     DataSources: make(map[string]RRDDataSource),
+    filter: filter,
   }
 
-  err := rrdFile.readRRD()
+  err := rrdFile.readRRD(ctx)
   if err != nil {
     return &rrdFile, err
   }
@@ -54,14 +154,28 @@ func NewRRDFile (fileLocation, name string) (*RRDFile, error) {
   return &rrdFile, nil
 }
 
+// NewUnreadRRDFile returns an RRDFile for fileLocation without reading
+// it, for callers that Update it straight away anyway, like a single
+// CollectOnce. Everything that comes from the file is zero until the
+// first Update fills it in, which doesn't count as a schema change.
+func NewUnreadRRDFile (fileLocation, name string, filter *DSFilter) *RRDFile {
+  return &RRDFile{
+    Location: fileLocation,
+    Name: name,
+    DataSources: make(map[string]RRDDataSource),
+    filter: filter,
+  }
+}
+
 // getRRDInfo abstracts the common logic for getting RRD info from either
-// a local file or URL source
-func (r *RRDFile) getRRDInfo() (map[string]interface{}, error) {
+// a local file or URL source. downloads are cancelled along with ctx,
+// local reads can't be interrupted so they're abandoned instead
+func (r *RRDFile) getRRDInfo(ctx context.Context) (map[string]interface{}, error) {
     if isURL(r.Location) {
         // Create temp file for HTTP source
         tmpFile, err := os.CreateTemp("", "rrd-*")
         if err != nil {
-            return nil, fmt.Errorf("failed to create temp file: %v", err)
+            return nil, fmt.Errorf("failed to create temp file: %w", err)
         }
         defer os.Remove(tmpFile.Name())
         defer tmpFile.Close()
@@ -71,91 +185,257 @@ func (r *RRDFile) getRRDInfo() (map[string]interface{}, error) {
         }
         client := &http.Client{Transport: tr}
 
-        resp, err := client.Get(r.Location)
+        req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.Location, nil)
+        if err != nil {
+            return nil, &FetchError{URL: r.Location, Err: err}
+        }
+
+        resp, err := client.Do(req)
         if err != nil {
-            return nil, fmt.Errorf("failed to download RRD: %v", err)
+            return nil, &FetchError{URL: r.Location, Err: err}
         }
         defer resp.Body.Close()
 
         if resp.StatusCode != http.StatusOK {
-            return nil, fmt.Errorf("bad status: %s", resp.Status)
+            return nil, &FetchError{URL: r.Location, StatusCode: resp.StatusCode}
         }
 
-        if _, err := io.Copy(tmpFile, resp.Body); err != nil {
-            return nil, fmt.Errorf("failed to save RRD: %v", err)
+        n, err := io.Copy(tmpFile, resp.Body)
+        r.bytesFetched.Add(uint64(n))
+        if err != nil {
+            return nil, &FetchError{URL: r.Location, Err: err}
         }
 
-        return rrd.Info(tmpFile.Name())
+        info, err := rrdInfo(tmpFile.Name())
+        if err != nil {
+            return nil, fmt.Errorf("%w: %s: %w", ErrCorrupt, r.Location, err)
+        }
+        return info, nil
     } 
     
-    return rrd.Info(r.Location)
+    info, err := r.localRRDInfo(ctx)
+    if err != nil {
+        // librrd only gives us a message, so check for ourselves whether
+        // the file is actually there
+        if ctx.Err() != nil {
+            return nil, err
+        }
+        if _, statErr := os.Stat(r.Location); errors.Is(statErr, fs.ErrNotExist) {
+            return nil, fmt.Errorf("%w: %s", ErrNotFound, r.Location)
+        }
+        // or whether it's there but we can't read it
+        f, openErr := os.Open(r.Location)
+        if openErr != nil {
+            return nil, fmt.Errorf("couldn't open %s: %w", r.Location, openErr)
+        }
+        f.Close()
+        return nil, fmt.Errorf("%w: %s: %w", ErrCorrupt, r.Location, err)
+    }
+
+    return info, nil
 }
 
-// Update refreshes only the last update time and data source values
-// without reparsing unchanging metadata.
-// I don't _believe_ that .rrd metadata changes, but if it does this 
-// approach will need to be changed.
+// localRRDInfo reads the info of a local file. librrd can block for a
+// long time on a slow or hung filesystem and has no way to be
+// interrupted, so the read runs on its own goroutine and is left to
+// finish in the background if ctx is done first.
+func (r *RRDFile) localRRDInfo(ctx context.Context) (map[string]interface{}, error) {
+    info := rrdInfo
+    if ctx.Done() == nil {
+        return info(r.Location)
+    }
+
+    type result struct {
+        info map[string]interface{}
+        err  error
+    }
+    results := make(chan result, 1)
+    go func() {
+        info, err := info(r.Location)
+        results <- result{info, err}
+    }()
+
+    select {
+    case res := <-results:
+        return res.info, res.err
+    case <-ctx.Done():
+        return nil, ctx.Err()
+    }
+}
+
+// Update refreshes the last update time and data source values.
+// The full metadata is parsed every time, since `rrdtool tune` can add
+// or remove data sources, change their type or change the step of a
+// file that's already being watched. When that happens the file is
+// switched over to the new schema and the update still succeeds,
+// LastSchemaChange describes what changed.
 func (r *RRDFile) Update() error {
-    info, err := r.getRRDInfo()
+    return r.UpdateContext(context.Background())
+}
+
+// UpdateContext is Update, giving up once ctx is done.
+func (r *RRDFile) UpdateContext(ctx context.Context) error {
+    info, err := r.getRRDInfo(ctx)
     if err != nil {
-        return fmt.Errorf("couldn't read RRD file: %v", err)
+        return fmt.Errorf("couldn't read RRD file: %w", err)
     }
 
-    // update last_update timestamp
-    if err := r.parseLastUpdate(info); err != nil {
+    lastUpdate, err := r.parseLastUpdate(info)
+    if err != nil {
         return err
     }
 
-    // update only the last values, not the full DS metadata
-    dsLast, ok := info["ds.last_ds"].(map[string]interface{})
-    if !ok {
-        return fmt.Errorf("couldn't parse ds last values")
-    }
-
-    for dsName, ds := range r.DataSources {
-        if lastVal, exists := dsLast[dsName]; exists {
-            lastValStr, ok := lastVal.(string) 
-            if !ok {
-                return fmt.Errorf("invalid last_ds value type for %s", dsName)
-            }
-            lastValUint, err := strconv.ParseUint(lastValStr, 10, 64)
-            if err != nil {
-                return fmt.Errorf("couldn't parse last_ds value for %s: %v", dsName, err)
-            }
-            ds.LastValue = lastValUint
-            r.DataSources[dsName] = ds
-        }
+    step, err := r.parseStep(info)
+    if err != nil {
+        return err
     }
 
+    // always a fresh map rather than writing into the published one, so
+    // anybody holding a snapshot keeps a consistent view
+    dataSources, err := r.parseDS(info)
+    if err != nil {
+        return err
+    }
+
+    // a layout that can't be parsed only costs the info metrics
+    version, rras, err := r.parseLayout(info)
+    if err != nil {
+        rras = nil
+    }
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    // a file created unread gets its schema from the first read, that's
+    // not a change
+    first := r.LastUpdate.IsZero()
+    change := diffSchema(r.Location, r.Step, step, r.DataSources, dataSources)
+    if first {
+        change = nil
+    }
+    r.LastUpdate = lastUpdate
+    r.DataSources = dataSources
+    r.Version = version
+    r.RRAs = rras
+    r.schemaChange = change
+    if change == nil && !first {
+        return nil
+    }
+
+    // the interval follows the step, unless it was set to something else
+    if r.Interval == r.Step {
+        r.Interval = step
+    }
+    r.Step = step
+
     return nil
 }
 
+// LastSchemaChange returns how the file's schema changed on the most
+// recent successful Update, or nil if it didn't.
+func (r *RRDFile) LastSchemaChange() *SchemaChange {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+
+    return r.schemaChange
+}
+
+// diffSchema compares the step and data sources from two reads of the
+// same file, returning nil if nothing changed.
+func diffSchema(location string, oldStep, newStep time.Duration, oldDS, newDS map[string]RRDDataSource) *SchemaChange {
+    change := &SchemaChange{Location: location, OldStep: oldStep, NewStep: newStep}
+
+    for name, ds := range newDS {
+        old, ok := oldDS[name]
+        switch {
+        case !ok:
+            change.Added = append(change.Added, name)
+        case old.Type != ds.Type:
+            change.Retyped = append(change.Retyped, name)
+        }
+    }
+    for name := range oldDS {
+        if _, ok := newDS[name]; !ok {
+            change.Removed = append(change.Removed, name)
+        }
+    }
+
+    if oldStep == newStep && len(change.Added) == 0 && len(change.Removed) == 0 && len(change.Retyped) == 0 {
+        return nil
+    }
+
+    sort.Strings(change.Added)
+    sort.Strings(change.Removed)
+    sort.Strings(change.Retyped)
+
+    return change
+}
+
+// Snapshot returns a consistent view of the last update time and data
+// source values. It's safe to call while Update is running.
+func (r *RRDFile) Snapshot() RRDSnapshot {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+
+    return RRDSnapshot{
+        Name:        r.Name,
+        Location:    r.Location,
+        Interval:    r.Interval,
+        Step:        r.Step,
+        Labels:      r.Labels,
+        LastUpdate:  r.LastUpdate,
+        DataSources: r.DataSources,
+        Version:     r.Version,
+        RRAs:        r.RRAs,
+    }
+}
+
+// BytesFetched returns how many bytes have been downloaded for this file
+// so far. It's always zero for local files.
+func (r *RRDFile) BytesFetched() uint64 {
+    return r.bytesFetched.Load()
+}
+
 // readRRD attempts to read and parse an RRD file from either a local path or URL
-func (r *RRDFile) readRRD() error {
-    info, err := r.getRRDInfo()
+func (r *RRDFile) readRRD(ctx context.Context) error {
+    info, err := r.getRRDInfo(ctx)
     if err != nil {
-        return fmt.Errorf("couldn't open rrd file at: %s (%v)", r.Location, err)
+        return fmt.Errorf("couldn't open rrd file at: %s (%w)", r.Location, err)
     }
 
     // parse all the RRD metadata
-    if err := r.parseLastUpdate(info); err != nil {
+    lastUpdate, err := r.parseLastUpdate(info)
+    if err != nil {
         return err
     }
+    r.LastUpdate = lastUpdate
 
-    if err := r.parseStep(info); err != nil {
+    step, err := r.parseStep(info)
+    if err != nil {
         return err
     }
+    r.Step = step
+    r.Interval = step
 
-    if err := r.parseDS(info); err != nil {
+    dataSources, err := r.parseDS(info)
+    if err != nil {
         return err
     }
+    r.DataSources = dataSources
+
+    // a layout that can't be parsed only costs the info metrics
+    if version, rras, err := r.parseLayout(info); err == nil {
+        r.Version, r.RRAs = version, rras
+    }
 
     return nil
 }
 
 
 
-func (r *RRDFile) parseDS(info map[string]interface{}) error {
+// parseDS builds a fresh map of data sources from the info map, leaving
+// out the ones the file's filter rejects without looking at them.
+func (r *RRDFile) parseDS(info map[string]interface{}) (map[string]RRDDataSource, error) {
   // dump structure of fields with which we are concerned:
   // (string) (len=10) "ds.last_ds": (map[string]interface {}) (len=2) {
   //  (string) (len=10) "traffic_in": (string) (len=15) "321105865553987",
@@ -188,19 +468,22 @@ func (r *RRDFile) parseDS(info map[string]interface{}) error {
   // set up some maps to temporarily hold the data after assertion 
   typesMap := make(map[string]string)
   indexMap := make(map[string]uint)
-  lastMap  := make(map[string]uint64)  
+  lastMap  := make(map[string]float64)  
 
 
   // double assert the types map
   dsTypes, ok := info["ds.type"].(map[string]interface{})
   if !ok {
-    return fmt.Errorf("couldn't parse ds types from %s", r.Location)
+    return nil, &ParseError{Location: r.Location, Field: "ds.type"}
   }
 
   for k, v := range dsTypes {
+    if !r.filter.Match(k) {
+      continue
+    }
     dsType, ok := v.(string)
     if !ok {
-      return fmt.Errorf("couldn't parse ds types from %s", r.Location)
+      return nil, &ParseError{Location: r.Location, Field: "ds.type"}
     }
     typesMap[k] = dsType
   }
@@ -208,12 +491,15 @@ func (r *RRDFile) parseDS(info map[string]interface{}) error {
   // double assert the indexes map 
   dsIndexes, ok := info["ds.index"].(map[string]interface{})
   if !ok {
-    return fmt.Errorf("couldn't parse ds indexes from %s", r.Location)
+    return nil, &ParseError{Location: r.Location, Field: "ds.index"}
   }
   for k, v := range dsIndexes  {
+    if !r.filter.Match(k) {
+      continue
+    }
     dsIndex, ok := v.(uint)
     if !ok {
-      return fmt.Errorf("couldn't parse ds indexes from %s", r.Location)
+      return nil, &ParseError{Location: r.Location, Field: "ds.index"}
     }
     indexMap[k] = dsIndex
   }
@@ -221,59 +507,203 @@ func (r *RRDFile) parseDS(info map[string]interface{}) error {
   // double assert the last_ds map 
   dsLast, ok := info["ds.last_ds"].(map[string]interface{})
   if !ok {
-    return fmt.Errorf("couldn't parse ds last from %s", r.Location)
+    return nil, &ParseError{Location: r.Location, Field: "ds.last_ds"}
   }
   for k, v := range dsLast {
+    if !r.filter.Match(k) {
+      continue
+    }
     lastDs, ok := v.(string)
     if !ok {
-      return fmt.Errorf("couldn't parse ds last from %s", r.Location)
+      return nil, &ParseError{Location: r.Location, Field: "ds.last_ds"}
+    }
+    // rrdtool writes U for a value it doesn't know
+    if lastDs == "U" {
+      lastMap[k] = math.NaN()
+      continue
     }
-    lastDsUint, err := strconv.ParseUint(lastDs, 10, 64)
+    lastDsFloat, err := strconv.ParseFloat(lastDs, 64)
     if err != nil {
-      return fmt.Errorf("couldn't parse ds last from %s", r.Location)
+      return nil, &ParseError{Location: r.Location, Field: "ds.last_ds", Err: err}
     }
-    lastMap[k] = lastDsUint 
+    lastMap[k] = lastDsFloat 
+  }
+
+  // min and max are missing for COMPUTE data sources, and librrd hands
+  // them over as NaN when they're unset
+  minMap, err := r.parseDSRange(info, "ds.min")
+  if err != nil {
+    return nil, err
+  }
+  maxMap, err := r.parseDSRange(info, "ds.max")
+  if err != nil {
+    return nil, err
+  }
+  heartbeatMap, err := r.parseDSHeartbeat(info)
+  if err != nil {
+    return nil, err
   }
 
 
   // all the assertion shenanigans are done with, so now we'll create 
-  // the ds instances and add them to the rrdfile struct field
+  // the ds instances and collect them up for the rrdfile struct field
+  dataSources := make(map[string]RRDDataSource, len(indexMap))
   for k, v := range indexMap {
     ds := RRDDataSource{
       Name: k,
       Index: v,
       Type: typesMap[k],
       LastValue: lastMap[k],
+      Min: math.NaN(),
+      Max: math.NaN(),
+      Heartbeat: heartbeatMap[k],
     }
-    r.DataSources[k] = ds
+    if min, ok := minMap[k]; ok {
+      ds.Min = min
+    }
+    if max, ok := maxMap[k]; ok {
+      ds.Max = max
+    }
+    dataSources[k] = ds
   }
 
   // spew.Dump(typesMap)
   // spew.Dump(indexMap)
   // spew.Dump(lastMap)
 
-  return nil
+  return dataSources, nil
 }
 
-func (r *RRDFile) parseStep(info map[string]interface{}) error {
+// parseDSRange reads one of the optional per data source float fields,
+// like ds.min, returning an empty map if the file doesn't have it.
+func (r *RRDFile) parseDSRange(info map[string]interface{}, field string) (map[string]float64, error) {
+  values := make(map[string]float64)
+
+  raw, ok := info[field]
+  if !ok {
+    return values, nil
+  }
+  byDS, ok := raw.(map[string]interface{})
+  if !ok {
+    return nil, &ParseError{Location: r.Location, Field: field}
+  }
+  for k, v := range byDS {
+    if !r.filter.Match(k) {
+      continue
+    }
+    value, ok := v.(float64)
+    if !ok {
+      return nil, &ParseError{Location: r.Location, Field: field}
+    }
+    values[k] = value
+  }
+
+  return values, nil
+}
+
+// parseDSHeartbeat reads ds.minimal_heartbeat, returning an empty map if
+// the file doesn't have it.
+func (r *RRDFile) parseDSHeartbeat(info map[string]interface{}) (map[string]time.Duration, error) {
+  heartbeats := make(map[string]time.Duration)
+
+  raw, ok := info["ds.minimal_heartbeat"]
+  if !ok {
+    return heartbeats, nil
+  }
+  byDS, ok := raw.(map[string]interface{})
+  if !ok {
+    return nil, &ParseError{Location: r.Location, Field: "ds.minimal_heartbeat"}
+  }
+  for k, v := range byDS {
+    if !r.filter.Match(k) {
+      continue
+    }
+    secs, ok := v.(uint)
+    if !ok {
+      return nil, &ParseError{Location: r.Location, Field: "ds.minimal_heartbeat"}
+    }
+    heartbeats[k] = time.Second * time.Duration(secs)
+  }
+
+  return heartbeats, nil
+}
+
+// parseLayout reads the file format version and the RRA definitions. 
+// both are optional and only feed the info metrics, so callers skip the
+// RRAs rather than fail the read when they can't be parsed. every RRA
+// has a cf, rows and pdp_per_row, the rest depends on the CF: xff is
+// only there for AVERAGE, MIN, MAX and LAST, and is NaN for the
+// Holt-Winters ones. librrd lists the RRAs as slices indexed by RRA:
+//  (string) (len=6) "rra.cf": ([]interface {}) (len=2) {
+//   (string) (len=7) "AVERAGE",
+//   (string) (len=3) "MAX"
+//  },
+func (r *RRDFile) parseLayout(info map[string]interface{}) (string, []RRA, error) {
+  var version string
+  if raw, ok := info["rrd_version"]; ok {
+    if version, ok = raw.(string); !ok {
+      return "", nil, &ParseError{Location: r.Location, Field: "rrd_version"}
+    }
+  }
+
+  raw, ok := info["rra.cf"]
+  if !ok {
+    return version, nil, nil
+  }
+  cfs, ok := raw.([]interface{})
+  if !ok {
+    return "", nil, &ParseError{Location: r.Location, Field: "rra.cf"}
+  }
+  rows, _ := info["rra.rows"].([]interface{})
+  pdpPerRow, _ := info["rra.pdp_per_row"].([]interface{})
+  xffs, _ := info["rra.xff"].([]interface{})
+
+  rras := make([]RRA, len(cfs))
+  for i := range cfs {
+    var rra RRA
+    if rra.CF, ok = cfs[i].(string); !ok {
+      return "", nil, &ParseError{Location: r.Location, Field: "rra.cf"}
+    }
+    if i >= len(rows) {
+      return "", nil, &ParseError{Location: r.Location, Field: "rra.rows"}
+    }
+    if rra.Rows, ok = rows[i].(uint); !ok {
+      return "", nil, &ParseError{Location: r.Location, Field: "rra.rows"}
+    }
+    if i >= len(pdpPerRow) {
+      return "", nil, &ParseError{Location: r.Location, Field: "rra.pdp_per_row"}
+    }
+    if rra.PDPPerRow, ok = pdpPerRow[i].(uint); !ok {
+      return "", nil, &ParseError{Location: r.Location, Field: "rra.pdp_per_row"}
+    }
+    rra.XFF = math.NaN()
+    if i < len(xffs) {
+      if xff, ok := xffs[i].(float64); ok {
+        rra.XFF = xff
+      }
+    }
+    rras[i] = rra
+  }
+
+  return version, rras, nil
+}
+
+func (r *RRDFile) parseStep(info map[string]interface{}) (time.Duration, error) {
   //  (string) (len=4) "step": (uint) 60,          
   stepVal, ok := info["step"].(uint)
   if !ok {
-    return fmt.Errorf("couldn't parse step from %s", r.Location)
+    return 0, &ParseError{Location: r.Location, Field: "step"}
   }
 
-  r.Interval = time.Second * time.Duration(stepVal)
-  
-  return nil
+  return time.Second * time.Duration(stepVal), nil
 }
 
 
 // parseLastUpdate takes the map of RRD info returned by rrd.Info() 
-// and pulls out the last_update field, converting it to native time.Time 
-// and updating the instance of RRDFile with this value.
+// and pulls out the last_update field, converting it to native time.Time.
 // Fails only if the unix timestamp couldn't be parsed/asserted from 
 // the info map.
-func (r *RRDFile) parseLastUpdate(info map[string]interface{}) error {
+func (r *RRDFile) parseLastUpdate(info map[string]interface{}) (time.Time, error) {
   // rrd keeps the lastupdate in a unix timestamp (uint)
   // but all of the rrd info fields are interfaces in the 
   // c wrapper, so we'll need to type assert back to uint 
@@ -281,7 +711,7 @@ func (r *RRDFile) parseLastUpdate(info map[string]interface{}) error {
   //  (string) (len=11) "last_update": (uint) 1735589344,
   lastUpdateVal, ok := info["last_update"].(uint)
   if !ok {
-    return fmt.Errorf("couldn't parse last_update from %s", r.Location)
+    return time.Time{}, &ParseError{Location: r.Location, Field: "last_update"}
   }
 
   // spew.Dump(info["last_update"])
@@ -291,9 +721,7 @@ func (r *RRDFile) parseLastUpdate(info map[string]interface{}) error {
   lastUpdateInt := int64(lastUpdateVal)
   lastUpdate := time.Unix(lastUpdateInt, 0)
 
-  r.LastUpdate = lastUpdate
-
-  return nil
+  return lastUpdate, nil
 }
 
 // isURL simply checks if str is a URL.
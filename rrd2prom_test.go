@@ -1,9 +1,14 @@
 package rrd2prom_test
 
 import (
+    "context"
+    "errors"
+    "io/fs"
     "net/http"
     "net/http/httptest"
     "os"
+    "path/filepath"
+    "sync"
     "testing"
     "time"
 
@@ -145,7 +150,7 @@ func testUpdateSuccessful(t *testing.T, f *testFixture) {
     
     // store initial values
     // initialUpdate := rrdFile.LastUpdate
-    initialVals := make(map[string]uint64)
+    initialVals := make(map[string]float64)
     for name, ds := range rrdFile.DataSources {
         initialVals[name] = ds.LastValue
     }
@@ -176,7 +181,7 @@ func testUpdateChangedValues(t *testing.T, f *testFixture) {
     
     // store initial values
     // initialUpdate := rrdFile.LastUpdate
-    initialVals := make(map[string]uint64)
+    initialVals := make(map[string]float64)
     for name, ds := range rrdFile.DataSources {
         initialVals[name] = ds.LastValue
     }
@@ -207,7 +212,7 @@ func testUpdateHTTP(t *testing.T, f *testFixture) {
     
     // store initial values
     // initialUpdate := rrdFile.LastUpdate
-    initialVals := make(map[string]uint64)
+    initialVals := make(map[string]float64)
     for name, ds := range rrdFile.DataSources {
         initialVals[name] = ds.LastValue
     }
@@ -231,3 +236,206 @@ func testUpdateHTTPError(t *testing.T, f *testFixture) {
         assert.Error(t, err) // should fail on update
     }
 }
+
+// test that snapshots stay consistent while the file is being updated,
+// run with -race to make sure readers and Update don't trip over each other
+func TestRRDFile_Snapshot(t *testing.T) {
+    fakes := newFakeRRDs(t)
+    fakes.set("port1.rrd", 1000, 1000)
+
+    rrdFile, err := rrd2prom.NewRRDFile("port1.rrd", "port1")
+    require.NoError(t, err)
+
+    done := make(chan struct{})
+    var wg sync.WaitGroup
+
+    // readers check that the value always matches the update time, since
+    // the fake writes them in lockstep
+    for i := 0; i < 4; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for {
+                select {
+                case <-done:
+                    return
+                default:
+                }
+                snap := rrdFile.Snapshot()
+                ds := snap.DataSources["traffic_in"]
+                assert.Equal(t, float64(snap.LastUpdate.Unix()), ds.LastValue)
+            }
+        }()
+    }
+
+    for i := uint(1001); i < 1200; i++ {
+        fakes.set("port1.rrd", i, uint64(i))
+        require.NoError(t, rrdFile.Update())
+    }
+    close(done)
+    wg.Wait()
+
+    snap := rrdFile.Snapshot()
+    assert.Equal(t, "port1", snap.Name)
+    assert.Equal(t, 60*time.Second, snap.Interval)
+    assert.Equal(t, time.Unix(1199, 0), snap.LastUpdate)
+    assert.Equal(t, float64(1199), snap.DataSources["traffic_in"].LastValue)
+}
+
+// test that failures can be told apart with errors.Is and errors.As
+func TestRRDFile_Errors(t *testing.T) {
+    fakes := newFakeRRDs(t)
+
+    t.Run("NotFound", func(t *testing.T) {
+        _, err := rrd2prom.NewRRDFile("missing.rrd", "missing")
+        assert.ErrorIs(t, err, rrd2prom.ErrNotFound)
+    })
+
+    t.Run("FetchFailed", func(t *testing.T) {
+        status := http.StatusServiceUnavailable
+        server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            w.WriteHeader(status)
+        }))
+        defer server.Close()
+
+        _, err := rrd2prom.NewRRDFile(server.URL, "port1")
+        var fetchErr *rrd2prom.FetchError
+        require.True(t, errors.As(err, &fetchErr))
+        assert.Equal(t, http.StatusServiceUnavailable, fetchErr.StatusCode)
+        assert.NotErrorIs(t, err, rrd2prom.ErrNotFound)
+
+        // a 404 counts as not found
+        status = http.StatusNotFound
+        _, err = rrd2prom.NewRRDFile(server.URL, "port1")
+        assert.ErrorIs(t, err, rrd2prom.ErrNotFound)
+    })
+
+    t.Run("Corrupt", func(t *testing.T) {
+        // the file is there, librrd just can't make sense of it
+        path := filepath.Join(t.TempDir(), "truncated.rrd")
+        require.NoError(t, os.WriteFile(path, []byte("RRD\x00"), 0o644))
+        _, err := rrd2prom.NewRRDFile(path, "truncated")
+        assert.ErrorIs(t, err, rrd2prom.ErrCorrupt)
+        assert.Contains(t, err.Error(), path)
+
+        // and a login page served in place of the file is no better
+        server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            w.Write([]byte("<html><body>Please log in</body></html>"))
+        }))
+        defer server.Close()
+
+        _, err = rrd2prom.NewRRDFile(server.URL, "port1")
+        assert.ErrorIs(t, err, rrd2prom.ErrCorrupt)
+        assert.Contains(t, err.Error(), server.URL)
+    })
+
+    t.Run("Permission", func(t *testing.T) {
+        if os.Geteuid() == 0 {
+            t.Skip("root can read anything")
+        }
+        path := filepath.Join(t.TempDir(), "private.rrd")
+        require.NoError(t, os.WriteFile(path, nil, 0))
+        _, err := rrd2prom.NewRRDFile(path, "private")
+        assert.ErrorIs(t, err, fs.ErrPermission)
+    })
+
+    t.Run("ParseError", func(t *testing.T) {
+        fakes.set("nostep.rrd", 1000, 1)
+        fakes.mu.Lock()
+        delete(fakes.infos["nostep.rrd"], "step")
+        fakes.mu.Unlock()
+
+        _, err := rrd2prom.NewRRDFile("nostep.rrd", "nostep")
+        var parseErr *rrd2prom.ParseError
+        require.True(t, errors.As(err, &parseErr))
+        assert.Equal(t, "step", parseErr.Field)
+    })
+}
+
+// test that Update follows the file when it's tuned underneath us
+func TestRRDFile_SchemaChange(t *testing.T) {
+    fakes := newFakeRRDs(t)
+    fakes.set("port1.rrd", 1000, 1)
+
+    rrdFile, err := rrd2prom.NewRRDFile("port1.rrd", "port1")
+    require.NoError(t, err)
+
+    // nothing changed
+    require.NoError(t, rrdFile.Update())
+    assert.Nil(t, rrdFile.LastSchemaChange())
+
+    // add a data source, retype the existing one and change the step
+    fakes.mu.Lock()
+    fakes.infos["port1.rrd"] = map[string]interface{}{
+        "step":        uint(300),
+        "last_update": uint(1300),
+        "ds.index":    map[string]interface{}{"traffic_in": uint(0), "traffic_out": uint(1)},
+        "ds.type":     map[string]interface{}{"traffic_in": "DERIVE", "traffic_out": "COUNTER"},
+        "ds.last_ds":  map[string]interface{}{"traffic_in": "5", "traffic_out": "7"},
+    }
+    fakes.mu.Unlock()
+
+    // it's not an error, the change is there to look at
+    require.NoError(t, rrdFile.Update())
+    change := rrdFile.LastSchemaChange()
+    require.NotNil(t, change)
+    assert.ErrorIs(t, change, rrd2prom.ErrSchemaChanged)
+    assert.Equal(t, []string{"traffic_out"}, change.Added)
+    assert.Empty(t, change.Removed)
+    assert.Equal(t, []string{"traffic_in"}, change.Retyped)
+    assert.Equal(t, 60*time.Second, change.OldStep)
+    assert.Equal(t, 300*time.Second, change.NewStep)
+
+    // the file has already moved over to the new schema
+    snap := rrdFile.Snapshot()
+    assert.Equal(t, 300*time.Second, snap.Interval)
+    assert.Equal(t, float64(7), snap.DataSources["traffic_out"].LastValue)
+    assert.Equal(t, "DERIVE", snap.DataSources["traffic_in"].Type)
+
+    // and a removed data source stops being reported
+    fakes.set("port1.rrd", 1600, 9)
+    fakes.mu.Lock()
+    fakes.infos["port1.rrd"]["step"] = uint(300)
+    fakes.mu.Unlock()
+
+    require.NoError(t, rrdFile.Update())
+    change = rrdFile.LastSchemaChange()
+    require.NotNil(t, change)
+    assert.Equal(t, []string{"traffic_out"}, change.Removed)
+    assert.NotContains(t, rrdFile.Snapshot().DataSources, "traffic_out")
+}
+
+// test that reads give up once their context is done
+func TestRRDFile_Context(t *testing.T) {
+    t.Run("HTTP", func(t *testing.T) {
+        server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            <-r.Context().Done()
+        }))
+        defer server.Close()
+
+        ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+        defer cancel()
+
+        _, err := rrd2prom.NewRRDFileContext(ctx, server.URL, "port1")
+        assert.ErrorIs(t, err, context.DeadlineExceeded)
+    })
+
+    t.Run("Local", func(t *testing.T) {
+        fakes := newFakeRRDs(t)
+        fakes.set("port1.rrd", 1000, 1)
+        rrdFile, err := rrd2prom.NewRRDFile("port1.rrd", "port1")
+        require.NoError(t, err)
+
+        // a read stuck on a hung filesystem is abandoned
+        release := make(chan struct{})
+        defer close(release)
+        t.Cleanup(rrd2prom.SetRRDInfo(func(location string) (map[string]interface{}, error) {
+            <-release
+            return fakes.info(location)
+        }))
+
+        ctx, cancel := context.WithCancel(context.Background())
+        cancel()
+        assert.ErrorIs(t, rrdFile.UpdateContext(ctx), context.Canceled)
+    })
+}
@@ -0,0 +1,436 @@
+package rrd2prom
+
+import (
+	"container/heap"
+	"context"
+	"hash/fnv"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// defaultWorkers is the size of the worker pool when WithWorkers isn't
+// used. Reading RRDs is mostly waiting on disk or network, so it's sized
+// well past the number of CPUs.
+var defaultWorkers = 4 * runtime.NumCPU()
+
+// default timings for step alignment, see WithUpdateGrace and
+// WithUpdateRetry
+const (
+	defaultUpdateGrace   = 5 * time.Second
+	defaultRetryDelay    = 5 * time.Second
+	defaultRetryAttempts = 3
+)
+
+// WithWorkers sets how many RRD files can be read at the same time.
+func WithWorkers(n int) Option {
+	return func(m *RRDManager) {
+		if n > 0 {
+			m.sched.workers = n
+		}
+	}
+}
+
+// WithUpdateGrace sets how long after an RRD's expected next write
+// (LastUpdate + Interval) the file is read, to give whatever writes it
+// time to finish.
+func WithUpdateGrace(grace time.Duration) Option {
+	return func(m *RRDManager) {
+		if grace >= 0 {
+			m.sched.grace = grace
+		}
+	}
+}
+
+// WithUpdateRetry sets how soon, and how many times, a file is read again
+// when it hadn't been written yet at its expected time. Zero attempts
+// disables retrying, so the file is next read an interval later.
+func WithUpdateRetry(delay time.Duration, attempts int) Option {
+	return func(m *RRDManager) {
+		if delay > 0 {
+			m.sched.retryDelay = delay
+		}
+		if attempts >= 0 {
+			m.sched.retryAttempts = attempts
+		}
+	}
+}
+
+// WithoutStepAlignment reads every file at a fixed interval from when it
+// was added, instead of following the file's own LastUpdate.
+func WithoutStepAlignment() Option {
+	return func(m *RRDManager) {
+		m.sched.align = false
+	}
+}
+
+// SchedulerStats is a point in time view of the scheduler, for sizing the
+// worker pool. Lateness is how long a file waited past its scheduled time
+// before a worker picked it up.
+type SchedulerStats struct {
+	Workers       int           // size of the worker pool
+	Busy          int           // workers reading a file right now
+	Scheduled     int           // files waiting for their next run
+	QueueDepth    int           // files already due but waiting for a worker
+	Runs          uint64        // runs handed to workers so far
+	TotalLateness time.Duration // lateness summed over all runs
+	MaxLateness   time.Duration // worst lateness seen
+}
+
+// scheduler runs collections for every handler from a bounded pool of
+// workers. Handlers wait in a min-heap ordered by their next run time, so
+// whichever handler is most overdue is always the next one picked up.
+type scheduler struct {
+	workers int
+
+	// align schedules runs just after each file is expected to be
+	// written, see nextRun
+	align         bool
+	grace         time.Duration
+	retryDelay    time.Duration
+	retryAttempts int
+
+	// maxBackoff caps how far apart reads of a failing file get
+	maxBackoff time.Duration
+
+	mu    sync.Mutex
+	queue handlerQueue
+	busy  int
+	stats SchedulerStats
+
+	// wake nudges the dispatcher when the head of the queue changes
+	wake chan struct{}
+	work chan *handler
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		workers:       defaultWorkers,
+		align:         true,
+		grace:         defaultUpdateGrace,
+		retryDelay:    defaultRetryDelay,
+		retryAttempts: defaultRetryAttempts,
+		maxBackoff:    defaultMaxBackoff,
+		wake:          make(chan struct{}, 1),
+	}
+}
+
+// start runs the dispatcher and the worker pool until ctx is done, calling
+// run for every handler that comes due. If run returns false the handler
+// isn't scheduled again. Every goroutine is tracked by wg.
+func (s *scheduler) start(ctx context.Context, wg *sync.WaitGroup, run func(*handler) bool) {
+	s.work = make(chan *handler)
+
+	wg.Add(1 + s.workers)
+	go func() {
+		defer wg.Done()
+		s.dispatch(ctx)
+	}()
+	for i := 0; i < s.workers; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case h := <-s.work:
+					s.finish(h, run(h))
+				}
+			}
+		}()
+	}
+}
+
+// dispatch hands due handlers to the workers, most overdue first.
+func (s *scheduler) dispatch(ctx context.Context) {
+	for {
+		s.mu.Lock()
+		var timer *time.Timer
+		var wait <-chan time.Time
+		var due *handler
+		if len(s.queue) > 0 {
+			head := s.queue[0]
+			if delay := time.Until(head.next); delay > 0 {
+				timer = time.NewTimer(delay)
+				wait = timer.C
+			} else {
+				due = heap.Pop(&s.queue).(*handler)
+				due.busy = true
+				s.busy++
+				s.recordLateness(-delay)
+			}
+		}
+		s.mu.Unlock()
+
+		if due == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.wake:
+			case <-wait:
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			continue
+		}
+
+		select {
+		case s.work <- due:
+		case <-ctx.Done():
+			// never made it to a worker, put it back for the next start
+			// unless it was removed while we were waiting
+			s.mu.Lock()
+			due.busy = false
+			s.busy--
+			if due.stopped {
+				close(due.done)
+			} else {
+				heap.Push(&s.queue, due)
+			}
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+// recordLateness adds a run to the stats. s.mu must be held.
+func (s *scheduler) recordLateness(lateness time.Duration) {
+	s.stats.Runs++
+	s.stats.TotalLateness += lateness
+	if lateness > s.stats.MaxLateness {
+		s.stats.MaxLateness = lateness
+	}
+}
+
+// add schedules h for its first run, straight away so there's data as
+// soon as possible after a start or reload. The runs after it are spread
+// out by nextRun rather than all firing at once.
+func (s *scheduler) add(h *handler) {
+	h.next = time.Now()
+	h.unphased = true
+
+	s.mu.Lock()
+	heap.Push(&s.queue, h)
+	s.mu.Unlock()
+	s.nudge()
+}
+
+// finish reschedules h after a worker is done with it, or lets a pending
+// remove know it has stopped. keep false takes h off the schedule for good.
+func (s *scheduler) finish(h *handler, keep bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h.busy = false
+	s.busy--
+	if h.stopped || !keep {
+		h.stopped = true
+		close(h.done)
+		return
+	}
+
+	h.next = s.nextRun(h, time.Now())
+	heap.Push(&s.queue, h)
+	s.nudge()
+}
+
+// nextRun works out when h should run after a run that finished at now.
+//
+// With alignment on, the next read is timed for just after the file is
+// expected to be written again, LastUpdate + Step + grace, so values lag
+// the upstream writer by seconds rather than up to a whole interval. An
+// interval shorter than the step polls at that interval in between
+// writes, a longer one skips writes but stays lined up with them. If the
+// file should have been written by now but hasn't been yet, it's looked
+// at again after a short retry delay. Files that have gone stale, or
+// whose retries ran out, fall back to a plain fixed interval, at a point
+// within it picked from the file's name after the first run so files are
+// spread out.
+//
+// Files that failed their last read are backed off instead, see backoff.
+func (s *scheduler) nextRun(h *handler, now time.Time) time.Time {
+	interval := h.interval()
+	unphased := h.unphased
+	h.unphased = false
+
+	h.health.mu.Lock()
+	failures := h.health.failures
+	h.health.mu.Unlock()
+	if failures > 0 {
+		return now.Add(s.backoff(interval, failures))
+	}
+
+	if s.align {
+		snap := h.file.Snapshot()
+		last := snap.LastUpdate
+		advanced := last.After(h.lastSeen)
+		h.lastSeen = last
+
+		step := snap.Step
+		if step <= 0 {
+			step = interval
+		}
+		due := last.Add(step + s.grace)
+		switch {
+		case last.IsZero():
+		case due.After(now):
+			h.retries = 0
+			if interval < step {
+				// poll in between writes, but never miss the write
+				if poll := now.Add(interval); poll.Before(due) {
+					return poll
+				}
+				return due
+			}
+			// the latest write that's no sooner than asked for
+			write := last.Add(step)
+			for !write.Add(step).After(now.Add(interval)) {
+				write = write.Add(step)
+			}
+			return write.Add(s.grace)
+		case !advanced && now.Sub(due) < step && h.retries < s.retryAttempts:
+			h.retries++
+			return now.Add(s.retryDelay)
+		}
+		h.retries = 0
+	}
+
+	// keep the phase by stepping forward a whole interval at a time,
+	// skipping any runs that were missed altogether. The first run was
+	// straight away, so the phase is picked now: half an interval to an
+	// interval and a half on, depending on the name
+	next := h.next.Add(interval)
+	if unphased {
+		next = h.next.Add(interval/2 + jitter(h.file.Name, interval))
+	}
+	for !next.After(now) {
+		next = next.Add(interval)
+	}
+
+	return next
+}
+
+// remove takes h off the schedule, waiting for it to finish if a worker
+// is busy with it.
+func (s *scheduler) remove(h *handler) {
+	s.mu.Lock()
+	if h.stopped {
+		// already taken off the schedule by its worker
+		s.mu.Unlock()
+		return
+	}
+	h.stopped = true
+	if h.busy {
+		s.mu.Unlock()
+		<-h.done
+		return
+	}
+	if h.index >= 0 {
+		heap.Remove(&s.queue, h.index)
+	}
+	close(h.done)
+	s.mu.Unlock()
+	s.nudge()
+}
+
+// reset empties the queue once the workers have stopped, so the handlers
+// can be added again by the next start.
+func (s *scheduler) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, h := range s.queue {
+		h.index = -1
+	}
+	s.queue = nil
+}
+
+// backoff returns how long to wait before reading a file again after
+// failures consecutive failures: its interval, doubling with each further
+// failure up to maxBackoff.
+func (s *scheduler) backoff(interval time.Duration, failures int) time.Duration {
+	max := s.maxBackoff
+	if max < interval {
+		max = interval
+	}
+
+	delay := interval
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+
+	return delay
+}
+
+// nudge wakes the dispatcher without blocking
+func (s *scheduler) nudge() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// snapshot returns the current scheduler stats
+func (s *scheduler) snapshot() SchedulerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.stats
+	stats.Workers = s.workers
+	stats.Busy = s.busy
+	stats.Scheduled = len(s.queue)
+
+	now := time.Now()
+	for _, h := range s.queue {
+		if !h.next.After(now) {
+			stats.QueueDepth++
+		}
+	}
+
+	return stats
+}
+
+// jitter spreads runs across interval, always landing the same file
+// at the same offset.
+func jitter(name string, interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(name))
+
+	return time.Duration(h.Sum64() % uint64(interval))
+}
+
+// handlerQueue is a min-heap of handlers ordered by next run time.
+type handlerQueue []*handler
+
+func (q handlerQueue) Len() int           { return len(q) }
+func (q handlerQueue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+
+func (q handlerQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *handlerQueue) Push(x any) {
+	h := x.(*handler)
+	h.index = len(*q)
+	*q = append(*q, h)
+}
+
+func (q *handlerQueue) Pop() any {
+	old := *q
+	n := len(old)
+	h := old[n-1]
+	old[n-1] = nil
+	h.index = -1
+	*q = old[:n-1]
+
+	return h
+}
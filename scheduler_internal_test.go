@@ -0,0 +1,137 @@
+package rrd2prom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduler_NextRun(t *testing.T) {
+	base := time.Unix(1735589340, 0)
+	interval := time.Minute
+
+	sched := newScheduler()
+	sched.grace = 5 * time.Second
+	sched.retryDelay = 2 * time.Second
+	sched.retryAttempts = 2
+
+	file := &RRDFile{Name: "port1", Interval: interval, LastUpdate: base}
+	h := &handler{file: file, next: base.Add(-30 * time.Second)}
+
+	// fresh write: wait for the next one plus the grace period
+	now := base.Add(time.Second)
+	next := sched.nextRun(h, now)
+	assert.Equal(t, base.Add(interval+5*time.Second), next)
+	h.next = next
+
+	// the file hasn't been written by the time we look, retry shortly
+	now = next
+	next = sched.nextRun(h, now)
+	assert.Equal(t, now.Add(2*time.Second), next)
+	next = sched.nextRun(h, next)
+	assert.Equal(t, now.Add(4*time.Second), next)
+
+	// out of retries, back to the plain interval
+	next = sched.nextRun(h, next)
+	assert.Equal(t, h.next.Add(interval), next)
+	h.next = next
+
+	// once the file is written again we're back in phase with it
+	file.LastUpdate = base.Add(interval + 10*time.Second)
+	now = file.LastUpdate.Add(time.Second)
+	assert.Equal(t, file.LastUpdate.Add(interval+5*time.Second), sched.nextRun(h, now))
+	assert.Zero(t, h.retries)
+}
+
+func TestScheduler_NextRunInterval(t *testing.T) {
+	base := time.Unix(1735589400, 0)
+	step := 5 * time.Minute
+
+	sched := newScheduler()
+	sched.grace = 5 * time.Second
+
+	// polling more often than the file is written lines up with the
+	// writes all the same
+	file := &RRDFile{Name: "port1", Interval: time.Minute, Step: step, LastUpdate: base}
+	h := &handler{file: file, next: base}
+	now := base.Add(time.Second)
+	assert.Equal(t, now.Add(time.Minute), sched.nextRun(h, now))
+	now = base.Add(4*time.Minute + 30*time.Second)
+	assert.Equal(t, base.Add(step+5*time.Second), sched.nextRun(h, now))
+
+	// and so does polling less often, skipping writes
+	file.Interval = 10 * time.Minute
+	now = base.Add(time.Second)
+	assert.Equal(t, base.Add(2*step+5*time.Second), sched.nextRun(h, now))
+}
+
+func TestScheduler_NextRunStale(t *testing.T) {
+	interval := time.Minute
+	now := time.Unix(1735589340, 0)
+
+	sched := newScheduler()
+
+	// a file that stopped being written long ago is read on a fixed
+	// interval instead of being retried
+	file := &RRDFile{Name: "port1", Interval: interval, LastUpdate: now.Add(-time.Hour)}
+	h := &handler{file: file, next: now.Add(-10 * time.Second), lastSeen: file.LastUpdate}
+	assert.Equal(t, now.Add(50*time.Second), sched.nextRun(h, now))
+
+	// and so is everything when alignment is off
+	sched.align = false
+	file.LastUpdate = now
+	assert.Equal(t, now.Add(50*time.Second), sched.nextRun(h, now))
+}
+
+func TestScheduler_FirstRun(t *testing.T) {
+	interval := time.Minute
+
+	sched := newScheduler()
+	sched.align = false
+
+	// the first run is straight away
+	file := &RRDFile{Name: "port1", Interval: interval}
+	h := &handler{file: file, index: -1}
+	before := time.Now()
+	sched.add(h)
+	assert.False(t, h.next.Before(before))
+	assert.False(t, h.next.After(time.Now()))
+
+	// and the one after it is spread out by name
+	start := h.next
+	next := sched.nextRun(h, start.Add(time.Second))
+	assert.Equal(t, start.Add(interval/2+jitter("port1", interval)), next)
+	h.next = next
+
+	// keeping that phase from then on
+	assert.Equal(t, next.Add(interval), sched.nextRun(h, next.Add(time.Second)))
+}
+
+func TestJitter(t *testing.T) {
+	interval := time.Minute
+
+	// stable per name and always within the interval
+	assert.Equal(t, jitter("port1", interval), jitter("port1", interval))
+	for _, name := range []string{"a", "b", "eth1/24", "port1", "port2"} {
+		j := jitter(name, interval)
+		assert.GreaterOrEqual(t, j, time.Duration(0))
+		assert.Less(t, j, interval)
+	}
+	assert.Zero(t, jitter("port1", 0))
+}
+
+func TestScheduler_Backoff(t *testing.T) {
+	sched := newScheduler()
+	sched.maxBackoff = 5 * time.Minute
+
+	interval := time.Minute
+	assert.Equal(t, time.Minute, sched.backoff(interval, 1))
+	assert.Equal(t, 2*time.Minute, sched.backoff(interval, 2))
+	assert.Equal(t, 4*time.Minute, sched.backoff(interval, 3))
+	assert.Equal(t, 5*time.Minute, sched.backoff(interval, 4))
+	assert.Equal(t, 5*time.Minute, sched.backoff(interval, 100))
+
+	// the cap never makes a failing file read more often than a healthy one
+	assert.Equal(t, 10*time.Minute, sched.backoff(10*time.Minute, 3))
+}
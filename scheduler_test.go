@@ -0,0 +1,107 @@
+package rrd2prom_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jessegalley/rrd2prom"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRRDManager_WorkerPool(t *testing.T) {
+	fakes := newFakeRRDs(t)
+
+	var files []*rrd2prom.RRDFile
+	for i := 0; i < 50; i++ {
+		files = append(files, newFastFile(t, fakes, fmt.Sprintf("port%d", i)))
+	}
+
+	// track how many files are being read at once
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	t.Cleanup(rrd2prom.SetRRDInfo(func(location string) (map[string]interface{}, error) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+
+		return fakes.info(location)
+	}))
+
+	m, sink := newManager(t, files, rrd2prom.WithWorkers(3))
+	startManager(t, m, sink)
+
+	// every file gets collected even though there are far fewer workers
+	seen := make(map[string]bool)
+	timeout := time.After(5 * time.Second)
+	for len(seen) < len(files) {
+		select {
+		case metric := <-sink.C:
+			seen[metric.File] = true
+		case <-timeout:
+			t.Fatalf("only %d of %d files were collected", len(seen), len(files))
+		}
+	}
+
+	mu.Lock()
+	assert.LessOrEqual(t, maxInFlight, 3)
+	mu.Unlock()
+
+	stats := m.SchedulerStats()
+	assert.Equal(t, 3, stats.Workers)
+	assert.NotZero(t, stats.Runs)
+	assert.GreaterOrEqual(t, stats.MaxLateness, time.Duration(0))
+	assert.LessOrEqual(t, stats.QueueDepth, stats.Scheduled)
+}
+
+func TestRRDManager_RemoveWhileBusy(t *testing.T) {
+	fakes := newFakeRRDs(t)
+	file := newFastFile(t, fakes, "port1")
+
+	// block the first read until the test lets it go
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	t.Cleanup(rrd2prom.SetRRDInfo(func(location string) (map[string]interface{}, error) {
+		once.Do(func() {
+			close(started)
+			<-release
+		})
+		return fakes.info(location)
+	}))
+
+	m, sink := newManager(t, []*rrd2prom.RRDFile{file}, rrd2prom.WithWorkers(1))
+	startManager(t, m, sink)
+	<-started
+
+	// Remove cancels the in flight read rather than waiting it out
+	removed := make(chan error)
+	go func() { removed <- m.Remove("port1") }()
+
+	select {
+	case err := <-removed:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Remove waited on a hung read")
+	}
+	close(release)
+
+	// and nothing from the abandoned read makes it out
+	select {
+	case metric := <-sink.C:
+		t.Fatalf("got %s from a removed file", metric.File)
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Empty(t, m.Files())
+}
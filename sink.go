@@ -0,0 +1,402 @@
+package rrd2prom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Sink receives the metrics collected by an RRDManager. WriteMetrics is
+// called with every metric from a single update of the RRD file called
+// file. An empty metrics slice means the file is no longer managed, so
+// sinks that keep state per file should forget about it. Removals are
+// never dropped, whatever the sink's policy, and batches of the file that
+// were still queued when it was removed are skipped.
+//
+// Each sink is fed from its own goroutine, so WriteMetrics is never called
+// concurrently for the same sink. Sinks that also implement io.Closer are
+// closed once the manager has shut down and their buffer has drained.
+type Sink interface {
+	WriteMetrics(file string, metrics []Metric) error
+}
+
+// SinkPolicy decides what happens to a batch of metrics when a sink's
+// buffer is full.
+type SinkPolicy int
+
+const (
+	// SinkDrop throws the batch away and counts it as dropped, so a slow
+	// sink can never hold up collection.
+	SinkDrop SinkPolicy = iota
+	// SinkBlock waits for the sink to catch up, holding up collection of
+	// the file the batch came from.
+	SinkBlock
+)
+
+// defaultSinkBuffer is how many batches are buffered for a sink when
+// SinkOptions.Buffer isn't set.
+const defaultSinkBuffer = 100
+
+// SinkOptions controls how metrics are delivered to a sink.
+type SinkOptions struct {
+	// Name identifies the sink in stats and events.
+	Name string
+	// Buffer is how many batches can be queued for the sink.
+	Buffer int
+	// Policy is what to do with a batch once the buffer is full.
+	Policy SinkPolicy
+}
+
+// SinkStats is a point in time view of how a sink is keeping up.
+type SinkStats struct {
+	Name    string
+	Queued  int    // batches waiting in the buffer right now
+	Batches uint64 // batches written to the sink
+	Metrics uint64 // metrics written to the sink
+	Dropped uint64 // metrics dropped because the buffer was full
+	Errors  uint64 // WriteMetrics calls that returned an error
+}
+
+// batch is a single delivery queued for a sink, seq is its place in the
+// order batches were queued
+type batch struct {
+	file    string
+	metrics []Metric
+	seq     uint64
+}
+
+// removal is a file removed from the manager that a sink has to be told
+// about. seq is the last batch queued before the removal, any batch of the
+// file up to it is stale.
+type removal struct {
+	seq     uint64
+	applied bool
+}
+
+// sinkRunner buffers batches for a single sink and feeds them to it from
+// its own goroutine.
+type sinkRunner struct {
+	sink  Sink
+	opts  SinkOptions
+	queue chan batch
+	done  chan struct{}
+
+	// closeErr is the error from closing the sink, if any, set before
+	// done is closed
+	closeErr error
+
+	// removals are handed to the sink apart from the queue, so a full
+	// queue can't lose them. wake tells the runner there's a new one.
+	// handled counts the batches that were written, skipped or dropped,
+	// once it's caught up with seq no stale batch can be left
+	seq        atomic.Uint64
+	handled    atomic.Uint64
+	removalsMu sync.Mutex
+	removals   map[string]removal
+	wake       chan struct{}
+
+	batches atomic.Uint64
+	metrics atomic.Uint64
+	dropped atomic.Uint64
+	errors  atomic.Uint64
+}
+
+// WithSink has the manager deliver metrics to sink, see SinkOptions for
+// how delivery behaves when the sink falls behind.
+func WithSink(sink Sink, opts SinkOptions) Option {
+	if opts.Buffer <= 0 {
+		opts.Buffer = defaultSinkBuffer
+	}
+
+	return func(m *RRDManager) {
+		m.sinks = append(m.sinks, &sinkRunner{
+			sink:     sink,
+			opts:     opts,
+			queue:    make(chan batch, opts.Buffer),
+			done:     make(chan struct{}),
+			removals: make(map[string]removal),
+			wake:     make(chan struct{}, 1),
+		})
+	}
+}
+
+// run writes queued batches to the sink until the queue is closed, then
+// closes the sink if it can be. Removals are handed over as soon as
+// they're noticed, ahead of whatever is queued.
+func (r *sinkRunner) run(m *RRDManager) {
+	defer close(r.done)
+
+	for open := true; open; {
+		select {
+		case b, ok := <-r.queue:
+			r.applyRemovals(m)
+			if !ok {
+				open = false
+				break
+			}
+			if !r.stale(b) {
+				r.write(m, b)
+			}
+			r.handled.Add(1)
+		case <-r.wake:
+			r.applyRemovals(m)
+		}
+	}
+
+	if closer, ok := r.sink.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			r.closeErr = fmt.Errorf("sink %s: %w", r.opts.Name, err)
+			m.emit(Event{Type: EventSinkFailed, Sink: r.opts.Name, Err: err})
+		}
+	}
+}
+
+// write hands a single batch to the sink
+func (r *sinkRunner) write(m *RRDManager, b batch) {
+	if err := r.sink.WriteMetrics(b.file, b.metrics); err != nil {
+		r.errors.Add(1)
+		m.emit(Event{Type: EventSinkFailed, File: b.file, Sink: r.opts.Name, Err: err})
+		return
+	}
+	r.batches.Add(1)
+	r.metrics.Add(uint64(len(b.metrics)))
+}
+
+// remove records that file is gone, for the runner to tell the sink
+func (r *sinkRunner) remove(file string) {
+	r.removalsMu.Lock()
+	r.removals[file] = removal{seq: r.seq.Load()}
+	r.removalsMu.Unlock()
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// applyRemovals tells the sink about every removal it hasn't heard of
+// yet. Removals it has heard of are forgotten once every batch queued
+// before them has been dealt with.
+func (r *sinkRunner) applyRemovals(m *RRDManager) {
+	r.removalsMu.Lock()
+	settled := r.handled.Load() == r.seq.Load()
+	var files []string
+	for file, rm := range r.removals {
+		switch {
+		case !rm.applied:
+			files = append(files, file)
+			r.removals[file] = removal{seq: rm.seq, applied: true}
+		case settled:
+			delete(r.removals, file)
+		}
+	}
+	r.removalsMu.Unlock()
+
+	for _, file := range files {
+		r.write(m, batch{file: file})
+	}
+}
+
+// stale reports whether b was queued before its file was removed
+func (r *sinkRunner) stale(b batch) bool {
+	r.removalsMu.Lock()
+	defer r.removalsMu.Unlock()
+
+	rm, ok := r.removals[b.file]
+	if !ok {
+		return false
+	}
+	if b.seq <= rm.seq {
+		r.dropped.Add(uint64(len(b.metrics)))
+		return true
+	}
+	delete(r.removals, b.file)
+
+	return false
+}
+
+// stats returns the current stats for the sink
+func (r *sinkRunner) stats() SinkStats {
+	return SinkStats{
+		Name:    r.opts.Name,
+		Queued:  len(r.queue),
+		Batches: r.batches.Load(),
+		Metrics: r.metrics.Load(),
+		Dropped: r.dropped.Load(),
+		Errors:  r.errors.Load(),
+	}
+}
+
+// fanOut hands a batch to every sink according to its policy. With
+// SinkBlock it waits for room until ctx is done, in which case the batch
+// is dropped.
+func (m *RRDManager) fanOut(ctx context.Context, file string, metrics []Metric) {
+	m.sinkMu.RLock()
+	defer m.sinkMu.RUnlock()
+
+	if m.sinksClosed {
+		return
+	}
+
+	for _, r := range m.sinks {
+		b := batch{file: file, metrics: metrics, seq: r.seq.Add(1)}
+		if r.opts.Policy == SinkBlock {
+			select {
+			case r.queue <- b:
+			case <-ctx.Done():
+				r.dropped.Add(uint64(len(metrics)))
+				r.handled.Add(1)
+			}
+			continue
+		}
+
+		select {
+		case r.queue <- b:
+		default:
+			r.dropped.Add(uint64(len(metrics)))
+			r.handled.Add(1)
+		}
+	}
+}
+
+// forget tells every sink the file called file is no longer managed.
+// Unlike batches, removals are kept while the sinks are closed and handed
+// over once they're started again.
+func (m *RRDManager) forget(file string) {
+	m.sinkMu.RLock()
+	defer m.sinkMu.RUnlock()
+
+	for _, r := range m.sinks {
+		r.remove(file)
+	}
+}
+
+// startSinks starts a goroutine per sink, with fresh buffers if the
+// sinks were closed by a previous run.
+func (m *RRDManager) startSinks() {
+	m.sinkMu.Lock()
+	defer m.sinkMu.Unlock()
+
+	for _, r := range m.sinks {
+		if m.sinksClosed {
+			r.queue = make(chan batch, r.opts.Buffer)
+			r.done = make(chan struct{})
+			r.closeErr = nil
+		}
+		go r.run(m)
+	}
+	m.sinksClosed = false
+}
+
+// closeSinks stops accepting batches and waits for every sink to drain
+// its buffer and close, returning the errors from closing them.
+func (m *RRDManager) closeSinks() []error {
+	m.sinkMu.Lock()
+	m.sinksClosed = true
+	for _, r := range m.sinks {
+		close(r.queue)
+		// sinks that could wait on somebody else forever are told to stop
+		// waiting, or the drain below might never end
+		if s, ok := r.sink.(interface{ stop() }); ok {
+			s.stop()
+		}
+	}
+	m.sinkMu.Unlock()
+
+	var errs []error
+	for _, r := range m.sinks {
+		<-r.done
+		if r.closeErr != nil {
+			errs = append(errs, r.closeErr)
+		}
+	}
+
+	return errs
+}
+
+// SinkStats returns the delivery stats of every sink, in the order the
+// sinks were added.
+func (m *RRDManager) SinkStats() []SinkStats {
+	m.sinkMu.RLock()
+	defer m.sinkMu.RUnlock()
+
+	stats := make([]SinkStats, 0, len(m.sinks))
+	for _, r := range m.sinks {
+		stats = append(stats, r.stats())
+	}
+
+	return stats
+}
+
+// ChanSink is a Sink that sends every metric down a channel, for callers
+// that want to consume metrics themselves. The channel is closed when the
+// manager shuts down, after which any further metrics are refused.
+type ChanSink struct {
+	C chan Metric
+
+	// mu keeps the channel from being closed while it's written to.
+	// stopped is closed when the manager starts shutting down
+	mu       sync.Mutex
+	closed   bool
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// NewChanSink creates a ChanSink whose channel buffers size metrics.
+func NewChanSink(size int) *ChanSink {
+	return &ChanSink{C: make(chan Metric, size), stopped: make(chan struct{})}
+}
+
+// WriteMetrics implements Sink. It blocks until every metric has been
+// received or buffered. Once the manager is shutting down it stops
+// waiting, so a consumer that stopped reading can't hold up shutdown:
+// metrics that don't fit in the buffer are dropped with an error.
+func (s *ChanSink) WriteMetrics(file string, metrics []Metric) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errors.New("chan sink is closed")
+	}
+
+	for i, metric := range metrics {
+		// room in the buffer wins over stopping
+		select {
+		case s.C <- metric:
+			continue
+		default:
+		}
+
+		select {
+		case s.C <- metric:
+		case <-s.stopped:
+			return fmt.Errorf("chan sink is stopping, dropped %d unread metrics", len(metrics)-i)
+		}
+	}
+
+	return nil
+}
+
+// stop stops WriteMetrics waiting for the consumer
+func (s *ChanSink) stop() {
+	s.stopOnce.Do(func() { close(s.stopped) })
+}
+
+// Close implements io.Closer by closing the channel.
+func (s *ChanSink) Close() error {
+	// let a write that's stuck waiting go first
+	s.stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.C)
+	}
+
+	return nil
+}
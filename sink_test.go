@@ -0,0 +1,268 @@
+package rrd2prom_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jessegalley/rrd2prom"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stuckSink never returns from WriteMetrics until released
+type stuckSink struct {
+	release chan struct{}
+}
+
+func (s *stuckSink) WriteMetrics(file string, metrics []rrd2prom.Metric) error {
+	<-s.release
+	return nil
+}
+
+// failingSink always fails
+type failingSink struct{}
+
+func (failingSink) WriteMetrics(file string, metrics []rrd2prom.Metric) error {
+	return errors.New("sink is broken")
+}
+
+func TestRRDManager_SinkFanOut(t *testing.T) {
+	fakes := newFakeRRDs(t)
+
+	store := rrd2prom.NewStore()
+	m, sink := newManager(t,
+		[]*rrd2prom.RRDFile{newFastFile(t, fakes, "port1")},
+		rrd2prom.WithSink(store, rrd2prom.SinkOptions{Name: "store"}),
+	)
+	startManager(t, m, sink)
+
+	// both sinks get the same metrics
+	waitForMetric(t, sink, "port1")
+	assert.Eventually(t, func() bool { return len(store.Metrics()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	stats := m.SinkStats()
+	require.Len(t, stats, 2)
+	assert.Equal(t, "store", stats[0].Name)
+	assert.Equal(t, "test", stats[1].Name)
+	assert.NotZero(t, stats[1].Metrics)
+}
+
+func TestRRDManager_SinkDropPolicy(t *testing.T) {
+	fakes := newFakeRRDs(t)
+
+	// a stuck sink with the drop policy must not hold up the others
+	stuck := &stuckSink{release: make(chan struct{})}
+	m, sink := newManager(t,
+		[]*rrd2prom.RRDFile{newFastFile(t, fakes, "port1")},
+		rrd2prom.WithSink(stuck, rrd2prom.SinkOptions{Name: "stuck", Buffer: 1, Policy: rrd2prom.SinkDrop}),
+	)
+	startManager(t, m, sink)
+	t.Cleanup(func() { close(stuck.release) })
+
+	for i := 0; i < 5; i++ {
+		waitForMetric(t, sink, "port1")
+	}
+
+	stats := m.SinkStats()
+	assert.Equal(t, 1, stats[0].Queued)
+	assert.NotZero(t, stats[0].Dropped)
+	assert.Zero(t, stats[1].Dropped)
+}
+
+// gatedSink records every batch, each write waiting for the gate to open
+type gatedSink struct {
+	gate chan struct{}
+
+	mu      sync.Mutex
+	batches []gatedBatch
+}
+
+type gatedBatch struct {
+	file    string
+	metrics []rrd2prom.Metric
+}
+
+func (s *gatedSink) WriteMetrics(file string, metrics []rrd2prom.Metric) error {
+	<-s.gate
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, gatedBatch{file: file, metrics: metrics})
+	return nil
+}
+
+func TestRRDManager_SinkRemoval(t *testing.T) {
+	fakes := newFakeRRDs(t)
+
+	// a removal has to get through even with the queue full
+	gated := &gatedSink{gate: make(chan struct{})}
+	m, sink := newManager(t,
+		[]*rrd2prom.RRDFile{newFastFile(t, fakes, "port1"), newFastFile(t, fakes, "port2")},
+		rrd2prom.WithSink(gated, rrd2prom.SinkOptions{Name: "gated", Buffer: 1, Policy: rrd2prom.SinkDrop}),
+	)
+	startManager(t, m, sink)
+
+	assert.Eventually(t, func() bool { return m.SinkStats()[0].Dropped > 0 }, 2*time.Second, 10*time.Millisecond)
+	require.NoError(t, m.Remove("port1"))
+	close(gated.gate)
+
+	removed := func() int {
+		gated.mu.Lock()
+		defer gated.mu.Unlock()
+		for i, b := range gated.batches {
+			if b.file == "port1" && len(b.metrics) == 0 {
+				return i
+			}
+		}
+		return -1
+	}
+	assert.Eventually(t, func() bool { return removed() >= 0 }, 2*time.Second, 10*time.Millisecond)
+
+	// and whatever of port1 was still queued never shows up after it
+	waitForMetric(t, sink, "port2")
+	at := removed()
+	gated.mu.Lock()
+	defer gated.mu.Unlock()
+	for _, b := range gated.batches[at+1:] {
+		assert.NotEqual(t, "port1", b.file)
+	}
+}
+
+func TestRRDManager_ChanSinkUnread(t *testing.T) {
+	fakes := newFakeRRDs(t)
+
+	// nobody reads the channel, shutting down mustn't wait on it forever
+	unread := rrd2prom.NewChanSink(1)
+	m, err := rrd2prom.NewRRDManager(
+		[]*rrd2prom.RRDFile{newFastFile(t, fakes, "port1")},
+		rrd2prom.WithSink(unread, rrd2prom.SinkOptions{Name: "unread", Policy: rrd2prom.SinkBlock}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, m.Start(context.Background()))
+	assert.Eventually(t, func() bool { return len(unread.C) == 1 }, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	require.NoError(t, m.Shutdown(ctx))
+}
+
+func TestRRDManager_SinkErrors(t *testing.T) {
+	fakes := newFakeRRDs(t)
+
+	var mu sync.Mutex
+	var failures []rrd2prom.Event
+	m, sink := newManager(t,
+		[]*rrd2prom.RRDFile{newFastFile(t, fakes, "port1")},
+		rrd2prom.WithSink(failingSink{}, rrd2prom.SinkOptions{Name: "broken"}),
+		rrd2prom.WithEventHandler(func(e rrd2prom.Event) {
+			if e.Type == rrd2prom.EventSinkFailed {
+				mu.Lock()
+				failures = append(failures, e)
+				mu.Unlock()
+			}
+		}),
+	)
+	startManager(t, m, sink)
+
+	waitForMetric(t, sink, "port1")
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(failures) > 0
+	}, 2*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	assert.Equal(t, "broken", failures[0].Sink)
+	assert.Equal(t, "port1", failures[0].File)
+	mu.Unlock()
+	assert.NotZero(t, m.SinkStats()[0].Errors)
+}
+
+func TestStore(t *testing.T) {
+	store := rrd2prom.NewStore()
+	now := time.Now()
+
+	require.NoError(t, store.WriteMetrics("port1", []rrd2prom.Metric{
+		{Name: "rrd_traffic_out", File: "port1", Source: "traffic_out", Value: 2, Timestamp: now},
+		{Name: "rrd_traffic_in", File: "port1", Source: "traffic_in", Value: 1, Timestamp: now},
+	}))
+	require.NoError(t, store.WriteMetrics("port2", []rrd2prom.Metric{
+		{Name: "rrd_traffic_in", File: "port2", Source: "traffic_in", Value: 3, Timestamp: now,
+			Labels: map[string]string{"site": "ams", "device": "sw1"}},
+		{Name: "rrd.weird", File: `we"ird`, Source: "weird", Value: 4, Timestamp: now},
+	}))
+
+	var buf bytes.Buffer
+	require.NoError(t, store.WriteText(&buf))
+	assert.Equal(t, `{"rrd.weird",file="we\"ird"} 4
+rrd_traffic_in{device="sw1",file="port2",site="ams"} 3
+rrd_traffic_in{file="port1"} 1
+rrd_traffic_out{file="port1"} 2
+`, buf.String())
+
+	// a new batch replaces the old one and an empty one forgets the file
+	require.NoError(t, store.WriteMetrics("port1", []rrd2prom.Metric{
+		{Name: "rrd_traffic_in", File: "port1", Source: "traffic_in", Value: 5, Timestamp: now},
+	}))
+	require.NoError(t, store.WriteMetrics("port2", nil))
+
+	rec := httptest.NewRecorder()
+	store.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, "rrd_traffic_in{file=\"port1\"} 5\n", rec.Body.String())
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/plain")
+}
+
+func TestStore_UTF8(t *testing.T) {
+	store := rrd2prom.NewStore()
+	require.NoError(t, store.WriteMetrics("port1", []rrd2prom.Metric{
+		{Name: "rrd.traffic_in", File: "port1", Source: "traffic_in", Value: 1,
+			Labels: map[string]string{"if.name": "eth1"}},
+	}))
+
+	// scrapers that don't ask for UTF-8 names get them escaped
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "text/plain;version=0.0.4;q=0.3,*/*;q=0.2")
+	store.ServeHTTP(rec, req)
+	assert.Equal(t, "rrd_traffic_in{file=\"port1\",if_name=\"eth1\"} 1\n", rec.Body.String())
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+
+	// the ones that do get them quoted, and are told so
+	rec = httptest.NewRecorder()
+	req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0;escaping=allow-utf-8;q=0.6,text/plain;version=1.0.0;escaping=allow-utf-8;q=0.4")
+	store.ServeHTTP(rec, req)
+	assert.Equal(t, "{\"rrd.traffic_in\",file=\"port1\",\"if.name\"=\"eth1\"} 1\n", rec.Body.String())
+	assert.Contains(t, rec.Header().Get("Content-Type"), "escaping=allow-utf-8")
+}
+
+func TestStore_Handler(t *testing.T) {
+	store := rrd2prom.NewStore()
+	require.NoError(t, store.WriteMetrics("port1", []rrd2prom.Metric{
+		{Name: "rrd.traffic_in", File: "port1", Source: "traffic_in", Value: 1},
+	}))
+	handler := store.Handler(func(w io.Writer) error {
+		_, err := io.WriteString(w, "rrd2prom_up 1\n")
+		return err
+	})
+
+	// the extra metrics follow the store's, which are negotiated the
+	// same way ServeHTTP does
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, "rrd_traffic_in{file=\"port1\"} 1\nrrd2prom_up 1\n", rec.Body.String())
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "text/plain;version=1.0.0;escaping=allow-utf-8")
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, "{\"rrd.traffic_in\",file=\"port1\"} 1\nrrd2prom_up 1\n", rec.Body.String())
+	assert.Contains(t, rec.Header().Get("Content-Type"), "escaping=allow-utf-8")
+}
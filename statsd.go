@@ -0,0 +1,219 @@
+package rrd2prom
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultStatsDPacket is the default largest StatsD packet, small enough
+// to fit an Ethernet MTU along with the IP and UDP headers
+const DefaultStatsDPacket = 1432
+
+// StatsDOptions configures a StatsDSink. Address is required.
+type StatsDOptions struct {
+	// Address is the host:port of the StatsD or DogStatsD agent, usually
+	// on port 8125
+	Address string
+	// MaxPacket is the largest packet sent, in bytes. Lines are packed
+	// into packets up to this size. Defaults to DefaultStatsDPacket
+	MaxPacket int
+	// SampleRate is the share of lines sent, between 0 and 1, the agent
+	// scaling counters back up. Defaults to 1, sending everything
+	SampleRate float64
+}
+
+// StatsDSink is a Sink that sends metrics to a DogStatsD agent over UDP.
+// COUNTER data sources are sent as counters (|c) of how much they went
+// up since the previous reading, allowing for wraps and resets like
+// rates are, so the first reading of each only sets a baseline. Every
+// other metric is sent as a gauge (|g). Labels, file included, are sent
+// as tags, and unknown values are left out.
+//
+// The socket is opened on the first write, and again on the next one
+// after Close.
+type StatsDSink struct {
+	opts StatsDOptions
+
+	// connMu guards conn and keeps packets in order
+	connMu sync.Mutex
+	conn   net.Conn
+
+	// mu guards counters, the previous reading of every COUNTER keyed by
+	// file and then series
+	mu       sync.Mutex
+	counters map[string]map[string]statsdReading
+}
+
+// statsdReading is a raw reading of a COUNTER
+type statsdReading struct {
+	value float64
+	at    int64
+}
+
+// NewStatsDSink creates a StatsDSink sending to opts.Address.
+func NewStatsDSink(opts StatsDOptions) (*StatsDSink, error) {
+	if opts.MaxPacket <= 0 {
+		opts.MaxPacket = DefaultStatsDPacket
+	}
+	if opts.SampleRate == 0 {
+		opts.SampleRate = 1
+	}
+	if opts.SampleRate < 0 || opts.SampleRate > 1 {
+		return nil, fmt.Errorf("invalid StatsD sample rate %g", opts.SampleRate)
+	}
+
+	if _, err := net.ResolveUDPAddr("udp", opts.Address); err != nil {
+		return nil, fmt.Errorf("invalid StatsD address %q: %w", opts.Address, err)
+	}
+
+	return &StatsDSink{
+		opts:     opts,
+		counters: make(map[string]map[string]statsdReading),
+	}, nil
+}
+
+// WriteMetrics implements Sink.
+func (s *StatsDSink) WriteMetrics(file string, metrics []Metric) error {
+	lines := s.lines(file, metrics)
+
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	var errs []error
+	var packet []byte
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > s.opts.MaxPacket {
+			errs = append(errs, s.send(packet))
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		errs = append(errs, s.send(packet))
+	}
+
+	return errors.Join(errs...)
+}
+
+// send sends a single packet, opening the socket first if needed.
+// s.connMu must be held by the caller.
+func (s *StatsDSink) send(packet []byte) error {
+	if s.conn == nil {
+		conn, err := net.Dial("udp", s.opts.Address)
+		if err != nil {
+			return fmt.Errorf("couldn't send to statsd: %w", err)
+		}
+		s.conn = conn
+	}
+	if _, err := s.conn.Write(packet); err != nil {
+		return fmt.Errorf("couldn't send to statsd: %w", err)
+	}
+	return nil
+}
+
+// lines formats metrics of file as StatsD lines, working out counter
+// deltas and leaving out the ones that aren't sampled
+func (s *StatsDSink) lines(file string, metrics []Metric) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(metrics) == 0 {
+		// the file is gone, so are its counters
+		delete(s.counters, file)
+		return nil
+	}
+
+	prev := s.counters[file]
+	next := make(map[string]statsdReading, len(prev))
+	s.counters[file] = next
+
+	lines := make([]string, 0, len(metrics))
+	for _, metric := range metrics {
+		if math.IsNaN(metric.Value) || math.IsInf(metric.Value, 0) {
+			continue
+		}
+
+		pairs := metric.labelPairs()
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+		tags := make([]string, 0, len(pairs))
+		for _, pair := range pairs {
+			if pair[1] != "" {
+				tags = append(tags, statsdClean(pair[0])+":"+statsdClean(pair[1]))
+			}
+		}
+
+		value, kind := metric.Value, "g"
+		if metric.Type == "COUNTER" {
+			// the counter wraps and resets as it's stored in the RRD, so the
+			// delta is worked out on that and transformed after
+			raw, scale := metric.Raw, metric.Scale
+			if scale == 0 {
+				raw, scale = metric.Value, 1
+			}
+			at := metric.LastUpdate.Unix()
+			key := metric.Name + "|" + strings.Join(tags, ",")
+			last, seen := prev[key]
+			next[key] = statsdReading{value: raw, at: at}
+			if !seen || last.at == at {
+				// nothing to compare to, or nothing new since last time
+				continue
+			}
+			value, kind = counterDelta(last.value, raw)*scale, "c"
+		}
+
+		// sampling comes after the counter's reading is kept, so the
+		// next delta doesn't cover the skipped one
+		if s.opts.SampleRate < 1 && rand.Float64() >= s.opts.SampleRate {
+			continue
+		}
+
+		line := statsdClean(metric.Name) + ":" + strconv.FormatFloat(value, 'g', -1, 64) + "|" + kind
+		if s.opts.SampleRate < 1 {
+			line += "|@" + strconv.FormatFloat(s.opts.SampleRate, 'g', -1, 64)
+		}
+		if len(tags) > 0 {
+			line += "|#" + strings.Join(tags, ",")
+		}
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// Close closes the sink's socket. The sink can still be written to
+// afterwards.
+func (s *StatsDSink) Close() error {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+
+	return err
+}
+
+// statsdClean replaces the characters that mean something in a StatsD
+// line
+func statsdClean(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', '\n', '\r':
+			return '_'
+		default:
+			return r
+		}
+	}, s)
+}
@@ -0,0 +1,166 @@
+package rrd2prom_test
+
+import (
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jessegalley/rrd2prom"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newStatsDServer listens for StatsD packets on a free local port
+func newStatsDServer(t *testing.T) net.PacketConn {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// readPackets reads packets from conn until none come for a little while
+func readPackets(t *testing.T, conn net.PacketConn) []string {
+	t.Helper()
+
+	var packets []string
+	buf := make([]byte, 65536)
+	for {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return packets
+		}
+		packets = append(packets, string(buf[:n]))
+	}
+}
+
+func newStatsDSink(t *testing.T, server net.PacketConn, opts rrd2prom.StatsDOptions) *rrd2prom.StatsDSink {
+	t.Helper()
+
+	opts.Address = server.LocalAddr().String()
+	sink, err := rrd2prom.NewStatsDSink(opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { sink.Close() })
+
+	return sink
+}
+
+func TestStatsDSink(t *testing.T) {
+	server := newStatsDServer(t)
+	sink := newStatsDSink(t, server, rrd2prom.StatsDOptions{})
+
+	write := func(at int64, traffic float64) {
+		t.Helper()
+		require.NoError(t, sink.WriteMetrics("port1", []rrd2prom.Metric{
+			{Name: "rrd_traffic_in", File: "port1", Type: "COUNTER", Value: traffic, Labels: map[string]string{"site": "ams"}, LastUpdate: time.Unix(at, 0)},
+			{Name: "rrd_temp", File: "port1", Type: "GAUGE", Value: 21.5, LastUpdate: time.Unix(at, 0)},
+			{Name: "rrd_load", File: "port1", Type: "GAUGE", Value: math.NaN(), LastUpdate: time.Unix(at, 0)},
+		}))
+	}
+
+	// the first reading of a counter only sets its baseline
+	write(60, 1000)
+	assert.Equal(t, []string{"rrd_temp:21.5|g|#file:port1"}, readPackets(t, server))
+
+	write(120, 1500)
+	assert.Equal(t, []string{"rrd_traffic_in:500|c|#file:port1,site:ams\nrrd_temp:21.5|g|#file:port1"}, readPackets(t, server))
+
+	// nothing new was written, so there's no delta
+	write(120, 1500)
+	assert.Equal(t, []string{"rrd_temp:21.5|g|#file:port1"}, readPackets(t, server))
+
+	// a counter that was reset counts up from zero
+	write(180, 100)
+	assert.Equal(t, []string{"rrd_traffic_in:100|c|#file:port1,site:ams\nrrd_temp:21.5|g|#file:port1"}, readPackets(t, server))
+
+	// once the file is gone its counters start over
+	require.NoError(t, sink.WriteMetrics("port1", nil))
+	write(240, 200)
+	assert.Equal(t, []string{"rrd_temp:21.5|g|#file:port1"}, readPackets(t, server))
+}
+
+func TestStatsDSink_Close(t *testing.T) {
+	server := newStatsDServer(t)
+	sink := newStatsDSink(t, server, rrd2prom.StatsDOptions{})
+	metrics := []rrd2prom.Metric{{Name: "rrd_temp", File: "port1", Type: "GAUGE", Value: 21.5}}
+
+	// a manager that's started again after shutting down carries on with
+	// the same sink
+	require.NoError(t, sink.WriteMetrics("port1", metrics))
+	require.NoError(t, sink.Close())
+	require.NoError(t, sink.WriteMetrics("port1", metrics))
+	assert.Equal(t, []string{"rrd_temp:21.5|g|#file:port1", "rrd_temp:21.5|g|#file:port1"}, readPackets(t, server))
+}
+
+func TestStatsDSink_Transformed(t *testing.T) {
+	server := newStatsDServer(t)
+	sink := newStatsDSink(t, server, rrd2prom.StatsDOptions{})
+
+	// bytes turned into bits, the delta is worked out on the bytes
+	write := func(at int64, traffic float64) {
+		t.Helper()
+		require.NoError(t, sink.WriteMetrics("port1", []rrd2prom.Metric{
+			{Name: "rrd_traffic_in_bits", File: "port1", Type: "COUNTER", Value: traffic * 8, Raw: traffic, Scale: 8, LastUpdate: time.Unix(at, 0)},
+		}))
+	}
+
+	write(60, math.Exp2(32)-296)
+	assert.Empty(t, readPackets(t, server))
+
+	// the counter wrapped at 32 bits, which its bits never would
+	write(120, 200)
+	assert.Equal(t, []string{"rrd_traffic_in_bits:3968|c|#file:port1"}, readPackets(t, server))
+}
+
+func TestStatsDSink_Packets(t *testing.T) {
+	server := newStatsDServer(t)
+	sink := newStatsDSink(t, server, rrd2prom.StatsDOptions{MaxPacket: 64})
+
+	metrics := make([]rrd2prom.Metric, 10)
+	for i := range metrics {
+		metrics[i] = rrd2prom.Metric{Name: "rrd_temp", File: "port1", Type: "GAUGE", Value: float64(i)}
+	}
+	require.NoError(t, sink.WriteMetrics("port1", metrics))
+
+	// every line is 26 bytes, so two fit in a packet
+	packets := readPackets(t, server)
+	require.Len(t, packets, 5)
+	for _, packet := range packets {
+		assert.LessOrEqual(t, len(packet), 64)
+		assert.Len(t, strings.Split(packet, "\n"), 2)
+	}
+}
+
+func TestStatsDSink_SampleRate(t *testing.T) {
+	server := newStatsDServer(t)
+	sink := newStatsDSink(t, server, rrd2prom.StatsDOptions{SampleRate: 0.5})
+
+	metrics := make([]rrd2prom.Metric, 200)
+	for i := range metrics {
+		metrics[i] = rrd2prom.Metric{Name: "rrd_temp", File: "port1", Type: "GAUGE", Value: float64(i)}
+	}
+	require.NoError(t, sink.WriteMetrics("port1", metrics))
+
+	var lines []string
+	for _, packet := range readPackets(t, server) {
+		lines = append(lines, strings.Split(packet, "\n")...)
+	}
+	assert.Greater(t, len(lines), 40)
+	assert.Less(t, len(lines), 160)
+	for _, line := range lines {
+		assert.True(t, strings.HasSuffix(line, "|g|@0.5|#file:port1"), line)
+	}
+
+	for _, bad := range []rrd2prom.StatsDOptions{
+		{Address: server.LocalAddr().String(), SampleRate: 2},
+		{Address: "no port"},
+	} {
+		_, err := rrd2prom.NewStatsDSink(bad)
+		assert.Error(t, err)
+	}
+}
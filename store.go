@@ -0,0 +1,181 @@
+package rrd2prom
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Content types of the text exposition format. Bodies with quoted UTF-8
+// names need the newer version, with escaping=allow-utf-8 telling the
+// scraper not to escape them itself.
+const (
+	textContentType     = "text/plain; version=0.0.4; charset=utf-8"
+	utf8TextContentType = "text/plain; version=1.0.0; charset=utf-8; escaping=allow-utf-8"
+)
+
+// Store is a Sink that keeps the latest metrics of every file in memory
+// and serves them in the Prometheus text exposition format.
+type Store struct {
+	mu    sync.RWMutex
+	files map[string][]Metric
+}
+
+// NewStore creates an empty Store.
+func NewStore() *Store {
+	return &Store{files: make(map[string][]Metric)}
+}
+
+// WriteMetrics implements Sink. Each batch replaces everything previously
+// stored for the file, so data sources that disappear stop being served.
+func (s *Store) WriteMetrics(file string, metrics []Metric) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(metrics) == 0 {
+		delete(s.files, file)
+		return nil
+	}
+	s.files[file] = metrics
+
+	return nil
+}
+
+// Metrics returns a copy of every stored metric sorted by name and then
+// labels.
+func (s *Store) Metrics() []Metric {
+	s.mu.RLock()
+	var metrics []Metric
+	for _, fileMetrics := range s.files {
+		metrics = append(metrics, fileMetrics...)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].Name != metrics[j].Name {
+			return metrics[i].Name < metrics[j].Name
+		}
+		return seriesKey(metrics[i]) < seriesKey(metrics[j])
+	})
+
+	return metrics
+}
+
+// WriteText writes every stored metric to w in the Prometheus text
+// exposition format. Names that aren't valid classic Prometheus names are
+// quoted, as the OpenMetrics UTF-8 names extension has it.
+func (s *Store) WriteText(w io.Writer) error {
+	return s.writeText(w, true)
+}
+
+// WriteLegacyText is like WriteText, but replaces the characters classic
+// Prometheus names can't have with _ instead of quoting them, for
+// consumers that don't take UTF-8 names.
+func (s *Store) WriteLegacyText(w io.Writer) error {
+	return s.writeText(w, false)
+}
+
+func (s *Store) writeText(w io.Writer, utf8 bool) error {
+	bw := bufio.NewWriter(w)
+	for _, metric := range s.Metrics() {
+		writeSeries(bw, metric, utf8)
+	}
+
+	return bw.Flush()
+}
+
+// writeSeries writes a single metric line. Names that aren't valid
+// classic Prometheus names are quoted inside the braces if utf8 is set,
+// and escaped otherwise.
+func writeSeries(w io.Writer, metric Metric, utf8 bool) {
+	labels := metric.labelPairs()
+	sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+
+	parts := make([]string, 0, len(labels)+1)
+	name := metric.Name
+	switch {
+	case isLegacyName(name):
+	case utf8:
+		parts = append(parts, `"`+escapeLabelValue(name)+`"`)
+		name = ""
+	default:
+		name = sanitizeName(name)
+	}
+	for _, label := range labels {
+		key := label[0]
+		switch {
+		case labelNameRE.MatchString(key):
+		case utf8:
+			key = `"` + escapeLabelValue(key) + `"`
+		default:
+			key = legacyLabelName(key)
+		}
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, key, escapeLabelValue(label[1])))
+	}
+
+	fmt.Fprintf(w, "%s{%s} %s\n", name, strings.Join(parts, ","), formatFloat(metric.Value))
+}
+
+// ServeHTTP implements http.Handler so the store can be mounted straight
+// on /metrics. Names are only quoted for scrapers that accept UTF-8
+// names, see AcceptsUTF8.
+func (s *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.serve(w, r, nil)
+}
+
+// Handler returns an http.Handler that serves the store like ServeHTTP
+// and then has each of extra write to the response, for metrics that
+// don't come from the store, like the manager's WriteSelfMetrics. They
+// must only write classic Prometheus names.
+func (s *Store) Handler(extra ...func(io.Writer) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serve(w, r, extra)
+	})
+}
+
+// serve writes the store to w followed by whatever extra writes, with
+// names quoted if the scraper that sent r accepts them
+func (s *Store) serve(w http.ResponseWriter, r *http.Request, extra []func(io.Writer) error) {
+	utf8 := AcceptsUTF8(r)
+	w.Header().Set("Content-Type", TextContentType(utf8))
+	s.writeText(w, utf8)
+	for _, write := range extra {
+		write(w)
+	}
+}
+
+// AcceptsUTF8 reports whether the scraper that sent r takes UTF-8 metric
+// and label names, which Prometheus says with escaping=allow-utf-8 in its
+// Accept header.
+func AcceptsUTF8(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(accept)
+		if err == nil && mediaType == "text/plain" && params["escaping"] == "allow-utf-8" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// TextContentType returns the Content-Type of the text exposition format,
+// with or without UTF-8 names.
+func TextContentType(utf8 bool) string {
+	if utf8 {
+		return utf8TextContentType
+	}
+	return textContentType
+}
+
+// labelValueEscaper escapes label values as the exposition format requires
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabelValue escapes backslashes, quotes and newlines in v.
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
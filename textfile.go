@@ -0,0 +1,147 @@
+package rrd2prom
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTextfileDelay is how long a TextfileSink waits after a batch
+// before writing the file, when no delay is given
+const DefaultTextfileDelay = time.Second
+
+// TextfileSink is a Sink that keeps a .prom file for node_exporter's
+// textfile collector up to date. The file holds the latest metrics of
+// every file as WriteLegacyText writes them, since the collector rejects
+// quoted UTF-8 names, and is rewritten in full a delay after a batch
+// comes in, so the batches of every file read around the same time end
+// up in a single write. The file is written to a temporary file in the
+// same directory first and renamed over the old one, so the collector
+// never sees half of it.
+type TextfileSink struct {
+	store *Store
+	path  string
+	delay time.Duration
+
+	// mu guards timer, which is set while a write is pending, and err,
+	// the error from the last write that happened in the background
+	mu    sync.Mutex
+	timer *time.Timer
+	err   error
+}
+
+// NewTextfileSink creates a TextfileSink writing to path, which has to
+// end in .prom for the collector to pick it up and be in a directory
+// that exists. delay is how long to wait for more batches before writing
+// the file, DefaultTextfileDelay if it's 0.
+func NewTextfileSink(path string, delay time.Duration) (*TextfileSink, error) {
+	if !strings.HasSuffix(path, ".prom") {
+		return nil, fmt.Errorf("textfile %s doesn't end in .prom", path)
+	}
+	info, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("textfile directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("textfile directory %s isn't a directory", filepath.Dir(path))
+	}
+
+	if delay <= 0 {
+		delay = DefaultTextfileDelay
+	}
+
+	return &TextfileSink{store: NewStore(), path: path, delay: delay}, nil
+}
+
+// WriteMetrics implements Sink. The file is written later on, an error
+// from doing so is returned by the next call.
+func (s *TextfileSink) WriteMetrics(file string, metrics []Metric) error {
+	if err := s.store.WriteMetrics(file, metrics); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.timer == nil {
+		s.timer = time.AfterFunc(s.delay, s.flush)
+	}
+	err := s.err
+	s.err = nil
+
+	return err
+}
+
+// flush writes the file once the delay is up
+func (s *TextfileSink) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.timer = nil
+	s.err = s.write()
+}
+
+// Close implements io.Closer by writing the file straight away if a write
+// is pending. The sink can still be written to afterwards.
+func (s *TextfileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+		err = s.write()
+	}
+	err = errors.Join(s.err, err)
+	s.err = nil
+
+	return err
+}
+
+// write renders the store and replaces the file with it
+func (s *TextfileSink) write() error {
+	var buf bytes.Buffer
+	if err := s.store.WriteLegacyText(&buf); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path, buf.Bytes())
+}
+
+// writeFileAtomic replaces path with data by writing it to a temporary
+// file next to it and renaming that into place. The temporary file's
+// name doesn't end in .prom, so the collector ignores it.
+func writeFileAtomic(path string, data []byte) error {
+	dir, base := filepath.Split(path)
+	tmp, err := os.CreateTemp(dir, "."+base+".tmp*")
+	if err != nil {
+		return fmt.Errorf("couldn't write textfile: %w", err)
+	}
+	// removing fails harmlessly once the rename has happened
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("couldn't write textfile: %w", err)
+	}
+	// CreateTemp makes the file readable by us only, the collector may
+	// well run as somebody else
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("couldn't write textfile: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("couldn't write textfile: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("couldn't write textfile: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package rrd2prom_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jessegalley/rrd2prom"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTextfileSink(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rrd2prom.prom")
+
+	sink, err := rrd2prom.NewTextfileSink(path, time.Hour)
+	require.NoError(t, err)
+
+	now := time.Now()
+	require.NoError(t, sink.WriteMetrics("port1", []rrd2prom.Metric{
+		{Name: "rrd_traffic_in", File: "port1", Source: "traffic_in", Value: 1, Timestamp: now},
+	}))
+	require.NoError(t, sink.WriteMetrics("port2", []rrd2prom.Metric{
+		{Name: "rrd_traffic_in", File: "port2", Source: "traffic_in", Value: 2, Timestamp: now,
+			Labels: map[string]string{"site": "ams"}},
+	}))
+
+	// nothing is written until the delay is up, or the sink is closed
+	_, err = os.Stat(path)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.NoError(t, sink.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "rrd_traffic_in{file=\"port1\"} 1\nrrd_traffic_in{file=\"port2\",site=\"ams\"} 2\n", string(data))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	// files that go away are dropped from it, and no temporary files
+	// are left behind
+	// the sink carries on after being closed
+	require.NoError(t, sink.WriteMetrics("port1", nil))
+	require.NoError(t, sink.Close())
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "rrd_traffic_in{file=\"port2\",site=\"ams\"} 2\n", string(data))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "rrd2prom.prom", entries[0].Name())
+}
+
+func TestTextfileSink_UTF8(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rrd2prom.prom")
+	sink, err := rrd2prom.NewTextfileSink(path, time.Hour)
+	require.NoError(t, err)
+
+	// the collector doesn't take quoted names, so they're escaped
+	require.NoError(t, sink.WriteMetrics("port1", []rrd2prom.Metric{
+		{Name: "rrd.traffic_in", File: "port1", Source: "traffic_in", Value: 1, Timestamp: time.Now(),
+			Labels: map[string]string{"site.name": "ams"}},
+	}))
+	require.NoError(t, sink.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "rrd_traffic_in{file=\"port1\",site_name=\"ams\"} 1\n", string(data))
+}
+
+func TestTextfileSink_Delay(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rrd2prom.prom")
+
+	sink, err := rrd2prom.NewTextfileSink(path, 50*time.Millisecond)
+	require.NoError(t, err)
+
+	// a batch per file, the way a round of reads comes in, makes a single
+	// write with all of them once the delay is up
+	var want strings.Builder
+	for i := range 20 {
+		file := fmt.Sprintf("port%02d", i)
+		require.NoError(t, sink.WriteMetrics(file, []rrd2prom.Metric{
+			{Name: "rrd_traffic_in", File: file, Source: "traffic_in", Value: float64(i), Timestamp: time.Now()},
+		}))
+		fmt.Fprintf(&want, "rrd_traffic_in{file=%q} %d\n", file, i)
+	}
+	_, err = os.Stat(path)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	require.Eventually(t, func() bool {
+		data, err := os.ReadFile(path)
+		return err == nil && string(data) == want.String()
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// errors from writing in the background show up on the next batch
+	require.NoError(t, os.Remove(path))
+	require.NoError(t, os.Mkdir(path, 0755))
+	require.NoError(t, sink.WriteMetrics("port00", nil))
+	require.Eventually(t, func() bool {
+		return sink.WriteMetrics("port01", nil) != nil
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestNewTextfileSink(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := rrd2prom.NewTextfileSink(filepath.Join(dir, "rrd2prom.txt"), 0)
+	assert.Error(t, err)
+
+	_, err = rrd2prom.NewTextfileSink(filepath.Join(dir, "missing", "rrd2prom.prom"), 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,357 @@
+package rrd2prom
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TransformConfig changes the value of a data source before it's
+// exported. The steps run in order: Expr, then Clamp, then Multiply and
+// Offset.
+type TransformConfig struct {
+	// Expr computes the value from the raw values of the file's data
+	// sources, like "traffic_in + traffic_out". It can use numbers, data
+	// source names, + - * / and parentheses; a data source that's
+	// unknown or missing, or dividing by zero, makes the result NaN. A
+	// transform with an Expr for a name the file doesn't have adds a new
+	// data source. If Expr only adds up data sources of one type, like
+	// COUNTERs, the new one has that type too and gets a rate, otherwise
+	// it's a GAUGE.
+	Expr string `yaml:"expr"`
+	// Clamp turns values of GAUGE data sources outside the data source's
+	// min and max into NaN, the way rrdtool treats them as unknown. For
+	// COUNTER, DERIVE and ABSOLUTE data sources min and max bound the rate,
+	// not the raw value, so they're left alone here, see WithRates
+	Clamp bool `yaml:"clamp"`
+	// Multiply scales the value, like 8 to turn bytes into bits or 0.1
+	// for tenths of a degree, defaults to 1
+	Multiply *float64 `yaml:"multiply"`
+	// Offset is added after multiplying
+	Offset float64 `yaml:"offset"`
+	// Unit is the unit of the result, passed to the name template as
+	// .Unit. The default template appends it to the name.
+	Unit string `yaml:"unit"`
+}
+
+// transform is a TransformConfig with its expression parsed
+type transform struct {
+	expr     expr
+	clamp    bool
+	multiply float64
+	offset   float64
+	unit     string
+}
+
+// Transformer applies transforms to the data sources of a file.
+type Transformer struct {
+	transforms map[string]transform
+	// derived are the names with an expression, in order, since they can
+	// add data sources the file doesn't have
+	derived []string
+}
+
+// NewTransformer parses the transforms for each data source, keyed by
+// data source name.
+func NewTransformer(configs map[string]TransformConfig) (*Transformer, error) {
+	t := &Transformer{transforms: make(map[string]transform, len(configs))}
+	for name, cfg := range configs {
+		tr := transform{clamp: cfg.Clamp, multiply: 1, offset: cfg.Offset, unit: cfg.Unit}
+		if cfg.Multiply != nil {
+			tr.multiply = *cfg.Multiply
+		}
+		if cfg.Expr != "" {
+			e, err := parseExpr(cfg.Expr)
+			if err != nil {
+				return nil, fmt.Errorf("transform %s: invalid expr %q: %w", name, cfg.Expr, err)
+			}
+			tr.expr = e
+			t.derived = append(t.derived, name)
+		}
+		if cfg.Unit != "" && sanitizeName(cfg.Unit) != cfg.Unit {
+			return nil, fmt.Errorf("transform %s: invalid unit %q", name, cfg.Unit)
+		}
+		t.transforms[name] = tr
+	}
+	sort.Strings(t.derived)
+
+	return t, nil
+}
+
+// dsValue is a data source along with its value and unit after
+// transforming, its value before multiply and offset, and what the
+// transform multiplied it by
+type dsValue struct {
+	ds    RRDDataSource
+	value float64
+	raw   float64
+	unit  string
+	scale float64
+	rate  bool
+}
+
+// values returns every data source in dataSources with its transformed
+// value, plus the ones added by expressions, sorted by name. A nil
+// Transformer returns the raw values.
+func (t *Transformer) values(dataSources map[string]RRDDataSource) []dsValue {
+	names := make([]string, 0, len(dataSources))
+	for name := range dataSources {
+		names = append(names, name)
+	}
+	if t != nil {
+		for _, name := range t.derived {
+			if _, ok := dataSources[name]; !ok {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	values := make([]dsValue, 0, len(names))
+	for _, name := range names {
+		ds, exists := dataSources[name]
+		if !exists {
+			ds = RRDDataSource{Name: name, Type: "GAUGE", Min: math.NaN(), Max: math.NaN()}
+		}
+		v := dsValue{ds: ds, value: ds.LastValue, raw: ds.LastValue, scale: 1}
+
+		if tr, ok := t.lookup(name); ok {
+			if tr.expr != nil {
+				v.value = tr.expr.eval(dataSources)
+				// rates are worked out on the data source's value, so it
+				// has to be the computed one
+				v.ds.LastValue = v.value
+				if dsType, ok := sumType(tr.expr, dataSources); ok && !exists {
+					v.ds.Type = dsType
+				}
+			}
+			// min and max of the other types bound their rate, which is
+			// checked when it's computed
+			if tr.clamp && v.ds.Type == "GAUGE" && (v.value < ds.Min || v.value > ds.Max) {
+				v.value = math.NaN()
+			}
+			v.raw = v.value
+			v.value = v.value*tr.multiply + tr.offset
+			v.unit = tr.unit
+			v.scale = tr.multiply
+		}
+		values = append(values, v)
+	}
+
+	return values
+}
+
+// lookup returns the transform for a data source, if there is one
+func (t *Transformer) lookup(name string) (transform, bool) {
+	if t == nil {
+		return transform{}, false
+	}
+	tr, ok := t.transforms[name]
+	return tr, ok
+}
+
+// expr is a parsed expression over data source values
+type expr interface {
+	eval(dataSources map[string]RRDDataSource) float64
+}
+
+type (
+	numberExpr float64
+	dsExpr     string
+	negExpr    struct{ x expr }
+	binaryExpr struct {
+		op   byte
+		l, r expr
+	}
+)
+
+func (e numberExpr) eval(map[string]RRDDataSource) float64 { return float64(e) }
+
+func (e dsExpr) eval(dataSources map[string]RRDDataSource) float64 {
+	ds, ok := dataSources[string(e)]
+	if !ok {
+		return math.NaN()
+	}
+	return ds.LastValue
+}
+
+func (e negExpr) eval(dataSources map[string]RRDDataSource) float64 {
+	return -e.x.eval(dataSources)
+}
+
+// sumType returns the type of the data sources e adds up, if all it does
+// is add up counters, derives or absolutes of the same type
+func sumType(e expr, dataSources map[string]RRDDataSource) (string, bool) {
+	switch e := e.(type) {
+	case dsExpr:
+		ds, ok := dataSources[string(e)]
+		if !ok || !hasRate(ds.Type) {
+			return "", false
+		}
+		return ds.Type, true
+	case binaryExpr:
+		if e.op != '+' {
+			return "", false
+		}
+		l, ok := sumType(e.l, dataSources)
+		if !ok {
+			return "", false
+		}
+		r, ok := sumType(e.r, dataSources)
+		if !ok || r != l {
+			return "", false
+		}
+		return l, true
+	default:
+		return "", false
+	}
+}
+
+func (e binaryExpr) eval(dataSources map[string]RRDDataSource) float64 {
+	l, r := e.l.eval(dataSources), e.r.eval(dataSources)
+	switch e.op {
+	case '+':
+		return l + r
+	case '-':
+		return l - r
+	case '*':
+		return l * r
+	default:
+		if r == 0 {
+			return math.NaN()
+		}
+		return l / r
+	}
+}
+
+// exprParser is a recursive descent parser for expressions:
+//
+//	sum     = product { ("+" | "-") product }
+//	product = unary { ("*" | "/") unary }
+//	unary   = "-" unary | primary
+//	primary = number | name | "(" sum ")"
+type exprParser struct {
+	src string
+	pos int
+}
+
+// parseExpr parses src into an expression
+func parseExpr(src string) (expr, error) {
+	p := &exprParser{src: src}
+	e, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		return nil, fmt.Errorf("unexpected %q at %d", p.src[p.pos], p.pos)
+	}
+
+	return e, nil
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// peek returns the next non space byte, or 0 at the end
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *exprParser) sum() (expr, error) {
+	l, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		r, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		l = binaryExpr{op: op, l: l, r: r}
+	}
+
+	return l, nil
+}
+
+func (p *exprParser) product() (expr, error) {
+	l, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '*' || op == '/'; op = p.peek() {
+		p.pos++
+		r, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l = binaryExpr{op: op, l: l, r: r}
+	}
+
+	return l, nil
+}
+
+func (p *exprParser) unary() (expr, error) {
+	if p.peek() == '-' {
+		p.pos++
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return negExpr{x}, nil
+	}
+
+	return p.primary()
+}
+
+func (p *exprParser) primary() (expr, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end")
+	case c == '(':
+		p.pos++
+		e, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ) at %d", p.pos)
+		}
+		p.pos++
+		return e, nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		start := p.pos
+		for p.pos < len(p.src) && strings.IndexByte("0123456789.", p.src[p.pos]) >= 0 {
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", p.src[start:p.pos])
+		}
+		return numberExpr(v), nil
+	case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+		start := p.pos
+		for p.pos < len(p.src) && isNameByte(p.src[p.pos]) {
+			p.pos++
+		}
+		return dsExpr(p.src[start:p.pos]), nil
+	default:
+		return nil, fmt.Errorf("unexpected %q at %d", c, p.pos)
+	}
+}
+
+// isNameByte reports whether c can be part of a data source name
+func isNameByte(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,135 @@
+package rrd2prom_test
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/jessegalley/rrd2prom"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTransformer(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  rrd2prom.TransformConfig
+		wantErr bool
+	}{
+		{"Empty", rrd2prom.TransformConfig{}, false},
+		{"Expr", rrd2prom.TransformConfig{Expr: "(traffic_in + traffic_out) * 8 / -2.5"}, false},
+		{"MissingParen", rrd2prom.TransformConfig{Expr: "(traffic_in + traffic_out"}, true},
+		{"TrailingOp", rrd2prom.TransformConfig{Expr: "traffic_in +"}, true},
+		{"BadChar", rrd2prom.TransformConfig{Expr: "traffic_in % 2"}, true},
+		{"BadNumber", rrd2prom.TransformConfig{Expr: "1.2.3"}, true},
+		{"Unit", rrd2prom.TransformConfig{Unit: "bits"}, false},
+		{"BadUnit", rrd2prom.TransformConfig{Unit: "°C"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := rrd2prom.NewTransformer(map[string]rrd2prom.TransformConfig{"ds": tt.config})
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestRRDManager_Transforms(t *testing.T) {
+	fakes := newFakeRRDs(t)
+	fakes.set("mrtg.rrd", 1735589344, 0)
+	fakes.mu.Lock()
+	info := fakes.infos["mrtg.rrd"]
+	info["ds.index"] = map[string]interface{}{"traffic_in": uint(0), "traffic_out": uint(1), "temp": uint(2), "humidity": uint(3), "spare": uint(4)}
+	info["ds.type"] = map[string]interface{}{"traffic_in": "COUNTER", "traffic_out": "COUNTER", "temp": "GAUGE", "humidity": "GAUGE", "spare": "GAUGE"}
+	info["ds.last_ds"] = map[string]interface{}{"traffic_in": "100", "traffic_out": "50", "temp": "215", "humidity": "140", "spare": "U"}
+	info["ds.min"] = map[string]interface{}{"traffic_in": 0.0, "traffic_out": 0.0, "temp": math.NaN(), "humidity": 0.0, "spare": math.NaN()}
+	info["ds.max"] = map[string]interface{}{"traffic_in": 50.0, "traffic_out": math.NaN(), "temp": math.NaN(), "humidity": 100.0, "spare": math.NaN()}
+	fakes.mu.Unlock()
+
+	store := rrd2prom.NewStore()
+	m, sink := newManager(t, nil, rrd2prom.WithSink(store, rrd2prom.SinkOptions{Name: "store"}))
+	startManager(t, m, sink)
+
+	require.NoError(t, m.ApplyConfig(writeConfig(t, `
+interval: 10ms
+transforms:
+  # max bounds a counter's rate, not its raw value
+  traffic_in: {multiply: 8, unit: bits, clamp: true}
+  traffic_out: {multiply: 8, unit: bits}
+sources:
+ - location: mrtg.rrd
+   transforms:
+     temp: {multiply: 0.1, offset: -1.5, unit: celsius}
+     humidity: {clamp: true}
+     traffic_total: {expr: "(traffic_in + traffic_out) * 8", unit: bits}
+`)))
+
+	files := filesByName(m)
+	ds := files["mrtg"].Snapshot().DataSources
+	assert.Equal(t, 100.0, ds["humidity"].Max)
+	assert.True(t, math.IsNaN(ds["temp"].Max))
+	assert.True(t, math.IsNaN(ds["spare"].LastValue))
+
+	assert.Eventually(t, func() bool { return len(store.Metrics()) == 6 }, 2*time.Second, 5*time.Millisecond)
+
+	var buf bytes.Buffer
+	require.NoError(t, store.WriteText(&buf))
+	assert.Equal(t, `rrd_humidity{file="mrtg"} NaN
+rrd_spare{file="mrtg"} NaN
+rrd_temp_celsius{file="mrtg"} 20
+rrd_traffic_in_bits{file="mrtg"} 800
+rrd_traffic_out_bits{file="mrtg"} 400
+rrd_traffic_total_bits{file="mrtg"} 1200
+`, buf.String())
+}
+
+func TestRRDManager_ExprType(t *testing.T) {
+	fakes := newFakeRRDs(t)
+	events := newEventRecorder()
+	store := rrd2prom.NewStore()
+
+	file := newFastFile(t, fakes, "port1")
+	var err error
+	file.Transform, err = rrd2prom.NewTransformer(map[string]rrd2prom.TransformConfig{
+		// a sum of counters is still a counter, so it gets a rate
+		"traffic_twice": {Expr: "traffic_in + traffic_in"},
+		// anything else is a gauge
+		"traffic_half": {Expr: "traffic_in / 2"},
+	})
+	require.NoError(t, err)
+
+	m, sink := newManager(t, []*rrd2prom.RRDFile{file},
+		events.option(),
+		rrd2prom.WithRates(rrd2prom.RatesAlongside),
+		rrd2prom.WithSink(store, rrd2prom.SinkOptions{Name: "store"}),
+	)
+
+	fakes.set("port1.rrd", 1735589340, 1000)
+	startManager(t, m, sink)
+	events.waitFor(t, rrd2prom.EventUpdateOK)
+
+	fakes.set("port1.rrd", 1735589400, 1600)
+	want := `rrd_traffic_half{file="port1"} 800
+rrd_traffic_in{file="port1"} 1600
+rrd_traffic_in_per_second{file="port1"} 10
+rrd_traffic_twice{file="port1"} 3200
+rrd_traffic_twice_per_second{file="port1"} 20
+`
+	assert.Eventually(t, func() bool {
+		var buf bytes.Buffer
+		require.NoError(t, store.WriteText(&buf))
+		return buf.String() == want
+	}, 2*time.Second, 5*time.Millisecond)
+
+	types := make(map[string]string)
+	for _, metric := range store.Metrics() {
+		types[metric.Name] = metric.Type
+	}
+	assert.Equal(t, "COUNTER", types["rrd_traffic_twice"])
+	assert.Equal(t, "GAUGE", types["rrd_traffic_half"])
+}